@@ -8,34 +8,74 @@ package gomp
 import (
 	"fmt"
 	"math"
-	"sort"
 )
 
+// BlendMode is the name of a blending mode.
+type BlendMode string
+
 const (
-	Normal     = "normal"
-	Darken     = "darken"
-	Lighten    = "lighten"
-	Multiply   = "multiply"
-	Screen     = "screen"
-	Overlay    = "overlay"
-	SoftLight  = "soft_light"
-	HardLight  = "hard_light"
-	ColorDodge = "color_dodge"
-	ColorBurn  = "color_burn"
-	Difference = "difference"
-	Exclusion  = "exclusion"
+	Normal     BlendMode = "normal"
+	Darken     BlendMode = "darken"
+	Lighten    BlendMode = "lighten"
+	Multiply   BlendMode = "multiply"
+	Screen     BlendMode = "screen"
+	Overlay    BlendMode = "overlay"
+	SoftLight  BlendMode = "soft_light"
+	HardLight  BlendMode = "hard_light"
+	ColorDodge BlendMode = "color_dodge"
+	ColorBurn  BlendMode = "color_burn"
+	Difference BlendMode = "difference"
+	Exclusion  BlendMode = "exclusion"
 
 	// Non-separable blend modes
-	Hue        = "hue"
-	Saturation = "saturation"
-	ColorMode  = "color"
-	Luminosity = "luminosity"
+	Hue        BlendMode = "hue"
+	Saturation BlendMode = "saturation"
+	ColorMode  BlendMode = "color"
+	Luminosity BlendMode = "luminosity"
+
+	// Photoshop blend modes
+	LinearDodge  BlendMode = "linear_dodge"
+	LinearBurn   BlendMode = "linear_burn"
+	VividLight   BlendMode = "vivid_light"
+	LinearLight  BlendMode = "linear_light"
+	PinLight     BlendMode = "pin_light"
+	HardMix      BlendMode = "hard_mix"
+	Subtract     BlendMode = "subtract"
+	Divide       BlendMode = "divide"
+	DarkerColor  BlendMode = "darker_color"
+	LighterColor BlendMode = "lighter_color"
+	Dissolve     BlendMode = "dissolve"
 )
 
+// BlendFunc computes the result of a blend mode for a single pixel.
+// The source and backdrop pixels, as well as the returned pixel, are non-premultiplied.
+// The color of the returned pixel is mixed with the source color depending on the
+// alpha of the backdrop, then it's composited by the active composition operation.
+// The alpha of the returned pixel is ignored, since the alpha of the result is
+// computed by the composition operation.
+type BlendFunc func(bl *Blend, src, dst Pixel) Pixel
+
 // Blend struct contains the currently active blend mode and all the supported blend modes.
+// Seed initializes the noise of the Dissolve blend mode, see SetSeed.
+// Model is the color model of the non-separable blend modes, see SetColorModel,
+// while Coeffs are the coefficients used for computing the luminosity, see SetLumCoeffs.
+// Space is the color space in which the blend modes are applied, see SetSpace.
+// If holds the optional Blend If ranges, see SetBlendIf.
+// Fill and Opacity are the fill and the layer opacity of the source, see SetFill and SetOpacity.
+// The linear flag is only set on the copies of the blend used by the gamma-correct compositing,
+// whose blend functions receive linear light values.
 type Blend struct {
-	Current string
-	Modes   []string
+	Current BlendMode
+	Modes   []BlendMode
+	Seed    int64
+	Model   ColorModel
+	Coeffs  LumCoeffs
+	Space   BlendSpace
+	If      *BlendIf
+	Fill    float64
+	Opacity float64
+	funcs   map[BlendMode]BlendFunc
+	linear  bool
 }
 
 // Color represents the RGB channel of a specific color.
@@ -45,31 +85,75 @@ type Color struct {
 
 // NewBlend initializes a new Blend.
 func NewBlend() *Blend {
-	return &Blend{
-		Modes: []string{
-			Normal,
-			Darken,
-			Lighten,
-			Multiply,
-			Screen,
-			Overlay,
-			SoftLight,
-			HardLight,
-			ColorDodge,
-			ColorBurn,
-			Difference,
-			Exclusion,
-			Hue,
-			Saturation,
-			ColorMode,
-			Luminosity,
-		},
+	bl := &Blend{
+		Model:   W3CModel,
+		Coeffs:  W3CLum,
+		Space:   RGBSpace,
+		Fill:    1,
+		Opacity: 1,
+		funcs:   make(map[BlendMode]BlendFunc),
 	}
+	for _, m := range []struct {
+		name BlendMode
+		fn   BlendFunc
+	}{
+		{Normal, blendNormal},
+		{Darken, blendDarken},
+		{Lighten, blendLighten},
+		{Multiply, blendMultiply},
+		{Screen, blendScreen},
+		{Overlay, blendOverlay},
+		{SoftLight, blendSoftLight},
+		{HardLight, blendHardLight},
+		{ColorDodge, blendColorDodge},
+		{ColorBurn, blendColorBurn},
+		{Difference, blendDifference},
+		{Exclusion, blendExclusion},
+		{Hue, blendHue},
+		{Saturation, blendSaturation},
+		{ColorMode, blendColor},
+		{Luminosity, blendLuminosity},
+		{LinearDodge, blendLinearDodge},
+		{LinearBurn, blendLinearBurn},
+		{VividLight, blendVividLight},
+		{LinearLight, blendLinearLight},
+		{PinLight, blendPinLight},
+		{HardMix, blendHardMix},
+		{Subtract, blendSubtract},
+		{Divide, blendDivide},
+		{DarkerColor, blendDarkerColor},
+		{LighterColor, blendLighterColor},
+		{Dissolve, blendNormal},
+	} {
+		bl.Register(m.name, m.fn)
+	}
+	return bl
+}
+
+// Register adds a custom blend mode under the provided name, which can be
+// activated afterwards with Set. Registering an already existing name
+// replaces its implementation.
+func (bl *Blend) Register(name BlendMode, fn BlendFunc) error {
+	if name == "" {
+		return fmt.Errorf("missing blend mode name")
+	}
+	if fn == nil {
+		return fmt.Errorf("missing blend function for %q", name)
+	}
+	if bl.funcs == nil {
+		bl.funcs = make(map[BlendMode]BlendFunc)
+	}
+	if _, ok := bl.funcs[name]; !ok {
+		bl.Modes = append(bl.Modes, name)
+	}
+	bl.funcs[name] = fn
+
+	return nil
 }
 
 // Set activate one of the supported blend modes.
-func (bl *Blend) Set(blendType string) error {
-	if Contains(bl.Modes, blendType) {
+func (bl *Blend) Set(blendType BlendMode) error {
+	if _, ok := bl.funcs[blendType]; ok {
 		bl.Current = blendType
 		return nil
 	}
@@ -77,13 +161,23 @@ func (bl *Blend) Set(blendType string) error {
 }
 
 // Get returns the active blend mode.
-func (bl *Blend) Get() string {
+func (bl *Blend) Get() BlendMode {
 	return bl.Current
 }
 
-// Lum gets the luminosity of a color.
+// SetSeed changes the seed of the noise used by the Dissolve blend mode. The noise depends
+// only on the seed and on the position of the pixels, so the same seed always produces the same output.
+func (bl *Blend) SetSeed(seed int64) {
+	bl.Seed = seed
+}
+
+// Lum gets the luminosity of a color, using the W3C coefficients unless other ones are set.
 func (bl *Blend) Lum(rgb Color) float64 {
-	return 0.3*rgb.R + 0.59*rgb.G + 0.11*rgb.B
+	c := bl.Coeffs
+	if c == (LumCoeffs{}) {
+		c = W3CLum
+	}
+	return c.R*rgb.R + c.G*rgb.G + c.B*rgb.B
 }
 
 // SetLum set the luminosity on a color.
@@ -123,42 +217,30 @@ func (bl *Blend) Sat(rgb Color) float64 {
 	return Max(rgb.R, rgb.G, rgb.B) - Min(rgb.R, rgb.G, rgb.B)
 }
 
-// channel is a key/value struct pair used for sorting the color channels
-// based on the color components having the minimum, middle, and maximum
-// values upon entry to the function.
-// The key component holds the channel name and val is the value it has.
-type channel struct {
-	key string
-	val float64
-}
-
+// SetSat set the saturation on a color. The minimum channel becomes zero, the maximum one
+// becomes s, while the middle channel is scaled proportionally between them.
 func (bl *Blend) SetSat(rgb Color, s float64) Color {
-	color := map[string]float64{
-		"R": rgb.R,
-		"G": rgb.G,
-		"B": rgb.B,
-	}
-	channels := make([]channel, 0, 3)
-	for k, v := range color {
-		channels = append(channels, channel{k, v})
-	}
-	// Sort the color channels based on their values.
-	sort.Slice(channels, func(i, j int) bool { return channels[i].val < channels[j].val })
-	minChan, midChan, maxChan := channels[0].key, channels[1].key, channels[2].key
-
-	if color[maxChan] > color[minChan] {
-		color[midChan] = (((color[midChan] - color[minChan]) * s) / (color[maxChan] - color[minChan]))
-		color[maxChan] = s
-	} else {
-		color[midChan], color[maxChan] = 0, 0
+	// Sort the pointers to the color channels based on their values.
+	min, mid, max := &rgb.R, &rgb.G, &rgb.B
+	if *min > *mid {
+		min, mid = mid, min
+	}
+	if *mid > *max {
+		mid, max = max, mid
+	}
+	if *min > *mid {
+		min, mid = mid, min
 	}
-	color[minChan] = 0
 
-	return Color{
-		R: color["R"],
-		G: color["G"],
-		B: color["B"],
+	if *max > *min {
+		*mid = ((*mid - *min) * s) / (*max - *min)
+		*max = s
+	} else {
+		*mid, *max = 0, 0
 	}
+	*min = 0
+
+	return rgb
 }
 
 // Applies the alpha blending formula for a blend operation.
@@ -175,3 +257,320 @@ func (bl *Blend) AlphaCompose(
 		(sourceAlpha / compositeAlpha *
 			math.Round((1-backdropAlpha)*sourceColor+backdropAlpha*compositeColor))
 }
+
+// separable applies a separable blend function on every color channel of the source and backdrop
+// pixels. The alpha is not a color, so it's kept from the source like in the non-separable modes.
+// See: https://www.w3.org/TR/compositing-1/#blendingseparable
+func separable(src, dst Pixel, fn func(s, b float64) float64) Pixel {
+	return Pixel{
+		R: fn(src.R, dst.R),
+		G: fn(src.G, dst.G),
+		B: fn(src.B, dst.B),
+		A: src.A,
+	}
+}
+
+// nonSeparable returns the color obtained by a non-separable blend mode, keeping the alpha of the source.
+// See: https://www.w3.org/TR/compositing-1/#blendingnonseparable
+func (bl *Blend) nonSeparable(src Pixel, rgb Color) Pixel {
+	return Pixel{R: rgb.R, G: rgb.G, B: rgb.B, A: src.A}
+}
+
+// mix replaces the color of the alpha-premultiplied source pixel with the color obtained
+// by blending it with the backdrop, as defined by the W3C compositing model:
+// Cs = (1 - αb) x Cs + αb x B(Cb, Cs). The composition operation is applied afterwards
+// on the mixed source, so the blend modes can be combined with any operation.
+// See: https://www.w3.org/TR/compositing-1/#blending
+func mix(bl *Blend, fn BlendFunc, src, dst Pixel) Pixel {
+	cs, cb := src.unpremultiply(), dst.unpremultiply()
+	res := fn(bl, cs, cb)
+
+	return Pixel{
+		R: (1-cb.A)*cs.R + cb.A*res.R,
+		G: (1-cb.A)*cs.G + cb.A*res.G,
+		B: (1-cb.A)*cs.B + cb.A*res.B,
+		A: cs.A,
+	}.premultiply()
+}
+
+func blendNormal(bl *Blend, src, dst Pixel) Pixel {
+	return src
+}
+
+func blendDarken(bl *Blend, src, dst Pixel) Pixel {
+	return separable(src, dst, func(s, b float64) float64 {
+		return Min(s, b)
+	})
+}
+
+func blendLighten(bl *Blend, src, dst Pixel) Pixel {
+	return separable(src, dst, func(s, b float64) float64 {
+		return Max(s, b)
+	})
+}
+
+func blendMultiply(bl *Blend, src, dst Pixel) Pixel {
+	return separable(src, dst, func(s, b float64) float64 {
+		return s * b
+	})
+}
+
+func blendScreen(bl *Blend, src, dst Pixel) Pixel {
+	return separable(src, dst, func(s, b float64) float64 {
+		return 1 - (1-s)*(1-b)
+	})
+}
+
+func blendOverlay(bl *Blend, src, dst Pixel) Pixel {
+	return separable(src, dst, func(s, b float64) float64 {
+		return hardLight(b, s)
+	})
+}
+
+func blendSoftLight(bl *Blend, src, dst Pixel) Pixel {
+	return separable(src, dst, func(s, b float64) float64 {
+		if s <= 0.5 {
+			return b - (1-2*s)*b*(1-b)
+		}
+		var d float64
+		if b <= 0.25 {
+			d = ((16*b-12)*b + 4) * b
+		} else {
+			d = math.Sqrt(b)
+		}
+		return b + (2*s-1)*(d-b)
+	})
+}
+
+func blendHardLight(bl *Blend, src, dst Pixel) Pixel {
+	return separable(src, dst, hardLight)
+}
+
+// hardLight multiplies or screens the colors, depending on the source color.
+// The overlay mode is the hard light mode with the source and the backdrop swapped.
+func hardLight(s, b float64) float64 {
+	if s <= 0.5 {
+		return b * 2 * s
+	}
+	s = 2*s - 1
+	return b + s - b*s
+}
+
+func blendColorDodge(bl *Blend, src, dst Pixel) Pixel {
+	return separable(src, dst, colorDodge)
+}
+
+func blendColorBurn(bl *Blend, src, dst Pixel) Pixel {
+	return separable(src, dst, colorBurn)
+}
+
+// colorDodge brightens the backdrop color to reflect the source color.
+func colorDodge(s, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	if s >= 1 {
+		return 1
+	}
+	return Min(1, b/(1-s))
+}
+
+// colorBurn darkens the backdrop color to reflect the source color.
+func colorBurn(s, b float64) float64 {
+	if b >= 1 {
+		return 1
+	}
+	if s <= 0 {
+		return 0
+	}
+	return 1 - Min(1, (1-b)/s)
+}
+
+func blendDifference(bl *Blend, src, dst Pixel) Pixel {
+	return separable(src, dst, func(s, b float64) float64 {
+		return Abs(b - s)
+	})
+}
+
+func blendExclusion(bl *Blend, src, dst Pixel) Pixel {
+	return separable(src, dst, func(s, b float64) float64 {
+		return s + b - 2*s*b
+	})
+}
+
+func blendHue(bl *Blend, src, dst Pixel) Pixel {
+	foreground := Color{R: src.R, G: src.G, B: src.B}
+	background := Color{R: dst.R, G: dst.G, B: dst.B}
+
+	if m, ok := bl.cylindrical(); ok {
+		hs, ss, _ := m.to(foreground)
+		h, s, l := m.to(background)
+		// The hue of the achromatic colors is undefined, so the backdrop keeps its own.
+		if ss > achromatic {
+			h = hs
+		}
+		return bl.nonSeparable(src, m.from(h, s, l))
+	}
+	sat := bl.SetSat(foreground, bl.Sat(background))
+	return bl.nonSeparable(src, bl.SetLum(sat, bl.Lum(background)))
+}
+
+func blendSaturation(bl *Blend, src, dst Pixel) Pixel {
+	foreground := Color{R: src.R, G: src.G, B: src.B}
+	background := Color{R: dst.R, G: dst.G, B: dst.B}
+
+	if m, ok := bl.cylindrical(); ok {
+		_, ss, _ := m.to(foreground)
+		h, sb, l := m.to(background)
+		// The hue of the achromatic colors is undefined, so the backdrop is kept unchanged.
+		if sb <= achromatic {
+			return bl.nonSeparable(src, background)
+		}
+		return bl.nonSeparable(src, m.from(h, ss, l))
+	}
+	sat := bl.SetSat(background, bl.Sat(foreground))
+	return bl.nonSeparable(src, bl.SetLum(sat, bl.Lum(background)))
+}
+
+func blendColor(bl *Blend, src, dst Pixel) Pixel {
+	foreground := Color{R: src.R, G: src.G, B: src.B}
+	background := Color{R: dst.R, G: dst.G, B: dst.B}
+
+	if m, ok := bl.cylindrical(); ok {
+		hs, ss, _ := m.to(foreground)
+		_, _, l := m.to(background)
+		return bl.nonSeparable(src, m.from(hs, ss, l))
+	}
+	return bl.nonSeparable(src, bl.SetLum(foreground, bl.Lum(background)))
+}
+
+func blendLuminosity(bl *Blend, src, dst Pixel) Pixel {
+	foreground := Color{R: src.R, G: src.G, B: src.B}
+	background := Color{R: dst.R, G: dst.G, B: dst.B}
+
+	if m, ok := bl.cylindrical(); ok {
+		_, _, ls := m.to(foreground)
+		h, s, _ := m.to(background)
+		return bl.nonSeparable(src, m.from(h, s, ls))
+	}
+	return bl.nonSeparable(src, bl.SetLum(background, bl.Lum(foreground)))
+}
+
+func blendLinearDodge(bl *Blend, src, dst Pixel) Pixel {
+	return separable(src, dst, func(s, b float64) float64 {
+		return Min(1, b+s)
+	})
+}
+
+func blendLinearBurn(bl *Blend, src, dst Pixel) Pixel {
+	return separable(src, dst, func(s, b float64) float64 {
+		return Max(0, b+s-1)
+	})
+}
+
+func blendVividLight(bl *Blend, src, dst Pixel) Pixel {
+	return separable(src, dst, vividLight)
+}
+
+// vividLight burns or dodges the colors by changing the contrast, depending on the source color.
+func vividLight(s, b float64) float64 {
+	if s <= 0.5 {
+		return colorBurn(2*s, b)
+	}
+	return colorDodge(2*s-1, b)
+}
+
+func blendLinearLight(bl *Blend, src, dst Pixel) Pixel {
+	return separable(src, dst, func(s, b float64) float64 {
+		return clampFloat(b+2*s-1, 0, 1)
+	})
+}
+
+func blendPinLight(bl *Blend, src, dst Pixel) Pixel {
+	return separable(src, dst, func(s, b float64) float64 {
+		if s <= 0.5 {
+			return Min(b, 2*s)
+		}
+		return Max(b, 2*s-1)
+	})
+}
+
+func blendHardMix(bl *Blend, src, dst Pixel) Pixel {
+	return separable(src, dst, func(s, b float64) float64 {
+		if s+b >= 1 {
+			return 1
+		}
+		return 0
+	})
+}
+
+func blendSubtract(bl *Blend, src, dst Pixel) Pixel {
+	return separable(src, dst, func(s, b float64) float64 {
+		return Max(0, b-s)
+	})
+}
+
+func blendDivide(bl *Blend, src, dst Pixel) Pixel {
+	return separable(src, dst, func(s, b float64) float64 {
+		if s == 0 {
+			if b == 0 {
+				return 0
+			}
+			return 1
+		}
+		return Min(1, b/s)
+	})
+}
+
+// blendDarkerColor keeps the source or the backdrop color, whichever has the lower luminosity.
+func blendDarkerColor(bl *Blend, src, dst Pixel) Pixel {
+	foreground := Color{R: src.R, G: src.G, B: src.B}
+	background := Color{R: dst.R, G: dst.G, B: dst.B}
+
+	if bl.lightness(foreground) < bl.lightness(background) {
+		return bl.nonSeparable(src, foreground)
+	}
+	return bl.nonSeparable(src, background)
+}
+
+// blendLighterColor keeps the source or the backdrop color, whichever has the higher luminosity.
+func blendLighterColor(bl *Blend, src, dst Pixel) Pixel {
+	foreground := Color{R: src.R, G: src.G, B: src.B}
+	background := Color{R: dst.R, G: dst.G, B: dst.B}
+
+	if bl.lightness(foreground) > bl.lightness(background) {
+		return bl.nonSeparable(src, foreground)
+	}
+	return bl.nonSeparable(src, background)
+}
+
+// dissolve keeps the alpha-premultiplied source pixel fully opaque or drops it completely, at random.
+// The probability of keeping the pixel is the alpha of the source multiplied with the density.
+func dissolve(src Pixel, density float64, seed uint64, x, y int) Pixel {
+	if src.A == 0 || noise(seed, x, y) >= src.A*density {
+		return Pixel{}
+	}
+	p := src.unpremultiply()
+	p.A = 1
+
+	return p
+}
+
+// noise returns a pseudo-random value in the [0, 1) range for the pixel at (x, y). It hashes the seed and
+// the coordinates with the SplitMix64 finalizer, so the value doesn't depend on the order of processing.
+// The seed is mixed on its own first, otherwise different seeds would only reorder the rows or the
+// columns of the same noise field.
+func noise(seed uint64, x, y int) float64 {
+	h := splitMix64(splitMix64(seed) ^ uint64(uint32(x))<<32 ^ uint64(uint32(y)))
+
+	return float64(h>>11) / (1 << 53)
+}
+
+// splitMix64 is a single round of the SplitMix64 generator.
+func splitMix64(h uint64) uint64 {
+	h += 0x9e3779b97f4a7c15
+	h = (h ^ h>>30) * 0xbf58476d1ce4e5b9
+	h = (h ^ h>>27) * 0x94d049bb133111eb
+
+	return h ^ h>>31
+}
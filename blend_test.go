@@ -4,6 +4,7 @@ import (
 	"image"
 	"image/color"
 	"image/draw"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -41,9 +42,43 @@ func TestBlend_Basic(t *testing.T) {
 	assert.Equal(Color{R: 0, G: 0, B: 0}, sat)
 }
 
+func TestBlend_Register(t *testing.T) {
+	assert := assert.New(t)
+
+	const average BlendMode = "average"
+
+	blop := NewBlend()
+	assert.Error(blop.Set(average))
+	assert.Error(blop.Register("", blendNormal))
+	assert.Error(blop.Register(average, nil))
+
+	err := blop.Register(average, func(bl *Blend, src, dst Pixel) Pixel {
+		return Pixel{
+			R: (src.R + dst.R) / 2,
+			G: (src.G + dst.G) / 2,
+			B: (src.B + dst.B) / 2,
+			A: Max(src.A, dst.A),
+		}
+	})
+	assert.NoError(err)
+	assert.Contains(blop.Modes, average)
+	assert.NoError(blop.Set(average))
+	assert.Equal(average, blop.Get())
+
+	rect := image.Rect(0, 0, 1, 1)
+	bmp := NewBitmap(rect)
+	source := image.NewNRGBA(rect)
+	backdrop := image.NewNRGBA(rect)
+	source.SetNRGBA(0, 0, color.NRGBA{R: 200, G: 0, B: 100, A: 255})
+	backdrop.SetNRGBA(0, 0, color.NRGBA{R: 100, G: 50, B: 0, A: 255})
+
+	InitOp().Draw(bmp, source, backdrop, blop)
+	assert.EqualValues([]uint8{150, 25, 50, 255}, bmp.Img.Pix)
+}
+
 func TestBlend_Modes(t *testing.T) {
-	// Note: all the expected values are taken by using as reference the results
-	// obtained in Photoshop by overlapping two layers and applying the blend mode.
+	// Note: the expected values follow the formulas of the W3C Compositing and Blending
+	// specification, see TestW3C_Conformance for the semi-transparent cases.
 	assert := assert.New(t)
 
 	imop := InitOp()
@@ -74,7 +109,7 @@ func TestBlend_Modes(t *testing.T) {
 	draw.Draw(backdrop, rect, &image.Uniform{orangeBack}, image.Point{}, draw.Src)
 	imop.Draw(bmp, source, backdrop, blop)
 
-	expected = []uint8{209, 9, 4, 255}
+	expected = []uint8{210, 9, 4, 255}
 	assert.EqualValues(expected, bmp.Img.Pix)
 
 	// Screen
@@ -83,7 +118,7 @@ func TestBlend_Modes(t *testing.T) {
 	draw.Draw(backdrop, rect, &image.Uniform{orangeBack}, image.Point{}, draw.Src)
 	imop.Draw(bmp, source, backdrop, blop)
 
-	expected = []uint8{254, 131, 77, 255}
+	expected = []uint8{254, 132, 78, 255}
 	assert.EqualValues(expected, bmp.Img.Pix)
 
 	// Overlay
@@ -92,7 +127,7 @@ func TestBlend_Modes(t *testing.T) {
 	draw.Draw(backdrop, rect, &image.Uniform{orangeBack}, image.Point{}, draw.Src)
 	imop.Draw(bmp, source, backdrop, blop)
 
-	expected = []uint8{253, 18, 8, 255}
+	expected = []uint8{253, 19, 9, 255}
 	assert.EqualValues(expected, bmp.Img.Pix)
 
 	// SoftLight
@@ -101,7 +136,7 @@ func TestBlend_Modes(t *testing.T) {
 	draw.Draw(backdrop, rect, &image.Uniform{orangeBack}, image.Point{}, draw.Src)
 	imop.Draw(bmp, source, backdrop, blop)
 
-	expected = []uint8{232, 19, 23, 255}
+	expected = []uint8{252, 67, 9, 255}
 	assert.EqualValues(expected, bmp.Img.Pix)
 
 	// HardLight
@@ -110,7 +145,7 @@ func TestBlend_Modes(t *testing.T) {
 	draw.Draw(backdrop, rect, &image.Uniform{orangeBack}, image.Point{}, draw.Src)
 	imop.Draw(bmp, source, backdrop, blop)
 
-	expected = []uint8{251, 67, 9, 255}
+	expected = []uint8{253, 19, 9, 255}
 	assert.EqualValues(expected, bmp.Img.Pix)
 
 	// ColorDodge
@@ -119,7 +154,7 @@ func TestBlend_Modes(t *testing.T) {
 	draw.Draw(backdrop, rect, &image.Uniform{orangeBack}, image.Point{}, draw.Src)
 	imop.Draw(bmp, source, backdrop, blop)
 
-	expected = []uint8{255, 131, 22, 255}
+	expected = []uint8{255, 131, 23, 255}
 	assert.EqualValues(expected, bmp.Img.Pix)
 
 	// ColorBurn
@@ -137,7 +172,7 @@ func TestBlend_Modes(t *testing.T) {
 	draw.Draw(backdrop, rect, &image.Uniform{orangeBack}, image.Point{}, draw.Src)
 	imop.Draw(bmp, source, backdrop, blop)
 
-	expected = []uint8{35, 101, 48, 255}
+	expected = []uint8{36, 101, 48, 255}
 	assert.EqualValues(expected, bmp.Img.Pix)
 
 	// Exclusion
@@ -172,7 +207,7 @@ func TestBlend_NonSeparableModes(t *testing.T) {
 	draw.Draw(backdrop, rect, &image.Uniform{backColor}, image.Point{}, draw.Src)
 	imop.Draw(bmp, source, backdrop, blop)
 
-	expected := []uint8{255, 97, 133, 255}
+	expected := []uint8{148, 66, 0, 255}
 	assert.EqualValues(expected, bmp.Img.Pix)
 
 	// Saturation
@@ -181,7 +216,7 @@ func TestBlend_NonSeparableModes(t *testing.T) {
 	draw.Draw(backdrop, rect, &image.Uniform{backColor}, image.Point{}, draw.Src)
 	imop.Draw(bmp, source, backdrop, blop)
 
-	expected = []uint8{233, 126, 39, 255}
+	expected = []uint8{240, 7, 61, 255}
 	assert.EqualValues(expected, bmp.Img.Pix)
 
 	// Color
@@ -190,7 +225,7 @@ func TestBlend_NonSeparableModes(t *testing.T) {
 	draw.Draw(backdrop, rect, &image.Uniform{backColor}, image.Point{}, draw.Src)
 	imop.Draw(bmp, source, backdrop, blop)
 
-	expected = []uint8{255, 97, 133, 255}
+	expected = []uint8{148, 66, 0, 255}
 	assert.EqualValues(expected, bmp.Img.Pix)
 
 	// Luminosity
@@ -199,6 +234,360 @@ func TestBlend_NonSeparableModes(t *testing.T) {
 	draw.Draw(backdrop, rect, &image.Uniform{backColor}, image.Point{}, draw.Src)
 	imop.Draw(bmp, source, backdrop, blop)
 
-	expected = []uint8{148, 66, 0, 255}
+	expected = []uint8{255, 97, 133, 255}
 	assert.EqualValues(expected, bmp.Img.Pix)
+
+	// The 8-bit results are the full precision results rounded to the nearest level.
+	bmp16 := NewBitmapFrom(image.NewNRGBA64(rect))
+	for _, mode := range []BlendMode{Hue, Saturation, ColorMode, Luminosity} {
+		blop.Set(mode)
+		imop.Draw(bmp, source, backdrop, blop)
+		imop.Draw(bmp16, source, backdrop, blop)
+
+		c := bmp16.Image().(*image.NRGBA64).NRGBA64At(0, 0)
+		round := func(v uint16) uint8 { return uint8((uint32(v)*0xff + 0x7fff) / 0xffff) }
+		expected = []uint8{round(c.R), round(c.G), round(c.B), 255}
+		assert.EqualValues(expected, bmp.Img.Pix, "mode %s", mode)
+	}
+}
+
+func TestBlend_SemiTransparent(t *testing.T) {
+	assert := assert.New(t)
+
+	imop := InitOp()
+	blop := NewBlend()
+	rect := image.Rect(0, 0, 1, 1)
+	bmp := NewBitmapFrom(image.NewNRGBA64(rect))
+
+	draw64 := func(src, dst color.NRGBA) color.NRGBA64 {
+		imop.DrawAt(bmp, rect, image.NewUniform(src), image.Point{}, image.NewUniform(dst), image.Point{}, blop)
+		return bmp.Image().(*image.NRGBA64).NRGBA64At(0, 0)
+	}
+	norm := func(c uint16) float64 { return float64(c) / 0xffff }
+
+	colors := [][2]color.NRGBA{
+		{{R: 214, G: 20, B: 65}, {R: 250, G: 121, B: 17}},
+		{{R: 33, G: 150, B: 243}, {R: 233, G: 30, B: 99}},
+		{{R: 255, G: 255, B: 0}, {R: 0, G: 128, B: 255}},
+		{{R: 10, G: 200, B: 90}, {R: 200, G: 10, B: 160}},
+	}
+	alphas := []uint8{0, 1, 64, 128, 192, 254, 255}
+
+	for _, mode := range blop.Modes {
+		// The dissolve mode keeps or drops the source pixels instead of compositing their alpha,
+		// see TestBlend_Dissolve.
+		if mode == Dissolve {
+			continue
+		}
+		blop.Set(mode)
+
+		for _, pair := range colors {
+			cs, cb := pair[0], pair[1]
+			cs.A, cb.A = 255, 255
+			// The opaque inputs give the result of the blend function B(Cb, Cs).
+			blended := draw64(cs, cb)
+
+			for _, sa := range alphas {
+				for _, ba := range alphas {
+					cs.A, cb.A = sa, ba
+					got := draw64(cs, cb)
+
+					as, ab := float64(sa)/255, float64(ba)/255
+					ao := as + ab - as*ab
+					assert.InDelta(ao, norm(got.A), 1e-4, "mode %s, alpha %d/%d", mode, sa, ba)
+					if ao == 0 {
+						continue
+					}
+					// Cs = (1 - αb) x Cs + αb x B(Cb, Cs), composited with source-over.
+					want := func(s, b uint8, res uint16) float64 {
+						mixed := (1-ab)*float64(s)/255 + ab*norm(res)
+						return (as*mixed + (1-as)*ab*float64(b)/255) / ao
+					}
+					msg := []interface{}{"mode %s, source %v, backdrop %v", mode, cs, cb}
+					assert.InDelta(want(cs.R, cb.R, blended.R), norm(got.R), 1e-4, msg...)
+					assert.InDelta(want(cs.G, cb.G, blended.G), norm(got.G), 1e-4, msg...)
+					assert.InDelta(want(cs.B, cb.B, blended.B), norm(got.B), 1e-4, msg...)
+				}
+			}
+
+			// A transparent backdrop leaves the source unchanged, and vice versa.
+			to64 := func(c color.NRGBA) color.NRGBA64 {
+				return color.NRGBA64{R: uint16(c.R) * 0x101, G: uint16(c.G) * 0x101, B: uint16(c.B) * 0x101, A: uint16(c.A) * 0x101}
+			}
+			cs.A, cb.A = 128, 0
+			assert.Equal(to64(cs), draw64(cs, cb), "mode %s", mode)
+			cs.A, cb.A = 0, 128
+			assert.Equal(to64(cb), draw64(cs, cb), "mode %s", mode)
+		}
+	}
+}
+
+func TestBlend_PhotoshopModes(t *testing.T) {
+	assert := assert.New(t)
+
+	imop := InitOp()
+	blop := NewBlend()
+	rect := image.Rect(0, 0, 1, 1)
+	bmp := NewBitmap(rect)
+
+	pink := color.NRGBA{R: 214, G: 20, B: 65, A: 255}
+	orange := color.NRGBA{R: 250, G: 121, B: 17, A: 255}
+	green := color.NRGBA{R: 100, G: 180, B: 128, A: 255}
+	blue := color.NRGBA{R: 90, G: 140, B: 200, A: 255}
+
+	for _, tc := range []struct {
+		mode     BlendMode
+		src, dst color.NRGBA
+		want     []uint8
+	}{
+		{LinearDodge, pink, orange, []uint8{255, 141, 82, 255}},
+		{LinearDodge, green, blue, []uint8{190, 255, 255, 255}},
+		{LinearBurn, pink, orange, []uint8{209, 0, 0, 255}},
+		{LinearBurn, green, blue, []uint8{0, 65, 73, 255}},
+		{VividLight, pink, orange, []uint8{255, 0, 0, 255}},
+		{VividLight, green, blue, []uint8{44, 238, 200, 255}},
+		{LinearLight, pink, orange, []uint8{255, 0, 0, 255}},
+		{LinearLight, green, blue, []uint8{35, 245, 201, 255}},
+		{PinLight, pink, orange, []uint8{250, 40, 17, 255}},
+		{PinLight, green, blue, []uint8{90, 140, 200, 255}},
+		{HardMix, pink, orange, []uint8{255, 0, 0, 255}},
+		{HardMix, green, blue, []uint8{0, 255, 255, 255}},
+		{Subtract, pink, orange, []uint8{36, 101, 0, 255}},
+		{Subtract, green, blue, []uint8{0, 0, 72, 255}},
+		{Divide, pink, orange, []uint8{255, 255, 66, 255}},
+		{Divide, green, blue, []uint8{229, 198, 255, 255}},
+		// The darker and lighter color modes keep the whole color with the lower or higher luminosity.
+		{DarkerColor, pink, orange, []uint8{214, 20, 65, 255}},
+		{DarkerColor, green, blue, []uint8{90, 140, 200, 255}},
+		{LighterColor, pink, orange, []uint8{250, 121, 17, 255}},
+		{LighterColor, green, blue, []uint8{100, 180, 128, 255}},
+	} {
+		assert.Contains(blop.Modes, tc.mode)
+		blop.Set(tc.mode)
+		imop.DrawAt(bmp, rect, image.NewUniform(tc.src), image.Point{}, image.NewUniform(tc.dst), image.Point{}, blop)
+		assert.True(compareBytes(tc.want, bmp.Img.Pix, 1), "%s: expected %v, got %v", tc.mode, tc.want, bmp.Img.Pix)
+	}
+
+	// Edge cases of the separable formulas, with the source and the backdrop values.
+	for _, tc := range []struct {
+		mode       BlendMode
+		s, b, want float64
+	}{
+		{VividLight, 0, 1, 1},
+		{VividLight, 0, 0.5, 0},
+		{VividLight, 1, 0, 0},
+		{VividLight, 1, 0.5, 1},
+		{VividLight, 0.5, 0.3, 0.3},
+		{LinearLight, 1, 1, 1},
+		{LinearLight, 0, 0, 0},
+		{LinearLight, 0.5, 0.3, 0.3},
+		{PinLight, 0.5, 0.3, 0.3},
+		{PinLight, 0.2, 0.6, 0.4},
+		{PinLight, 0.8, 0.3, 0.6},
+		{HardMix, 0.5, 0.5, 1},
+		{HardMix, 0.5, 0.49, 0},
+		{Subtract, 1, 0.5, 0},
+		{Divide, 0, 0, 0},
+		{Divide, 0, 0.5, 1},
+		{Divide, 0.5, 0.25, 0.5},
+	} {
+		blop.Set(tc.mode)
+		res := blop.funcs[tc.mode](blop, Pixel{R: tc.s, A: 1}, Pixel{R: tc.b, A: 1})
+		assert.InDelta(tc.want, res.R, 1e-9, "%s(%v, %v)", tc.mode, tc.s, tc.b)
+	}
+}
+
+func TestBlend_Noise(t *testing.T) {
+	assert := assert.New(t)
+
+	const size = 64
+	type line [size]bool
+	field := func(seed uint64) (cells, cols [size]line) {
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				cells[y][x] = noise(seed, x, y) < 0.5
+				cols[x][y] = cells[y][x]
+			}
+		}
+		return cells, cols
+	}
+	shared := func(a, b [size]line) int {
+		lines := make(map[line]bool)
+		for _, l := range a {
+			lines[l] = true
+		}
+		var n int
+		for _, l := range b {
+			if lines[l] {
+				n++
+			}
+		}
+		return n
+	}
+
+	// The fields of different seeds are independent, and not the rows or the columns of the
+	// same field reordered, which the seeds only differing in the low or high bits would give.
+	for _, seeds := range [][2]uint64{{1, 2}, {0, 1 << 32}, {42, 43}} {
+		a, acols := field(seeds[0])
+		b, bcols := field(seeds[1])
+		var same int
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				if a[y][x] == b[y][x] {
+					same++
+				}
+			}
+		}
+		assert.InDelta(0.5, float64(same)/(size*size), 0.05, "seeds %v", seeds)
+		assert.Zero(shared(a, b), "seeds %v", seeds)
+		assert.Zero(shared(acols, bcols), "seeds %v", seeds)
+	}
+}
+
+func TestBlend_Dissolve(t *testing.T) {
+	assert := assert.New(t)
+
+	rect := image.Rect(0, 0, 128, 128)
+	srcColor := color.NRGBA{R: 214, G: 20, B: 65, A: 255}
+	dstColor := color.NRGBA{R: 250, G: 121, B: 17, A: 255}
+	source := image.NewUniform(srcColor)
+	backdrop := image.NewUniform(dstColor)
+
+	imop := InitOp()
+	imop.SetWorkers(1)
+	blop := NewBlend()
+	blop.Set(Dissolve)
+	blop.SetSeed(42)
+
+	dissolve := func(src image.Image) *image.NRGBA {
+		bmp := NewBitmap(rect)
+		imop.DrawAt(bmp, rect, src, image.Point{}, backdrop, image.Point{}, blop)
+		return bmp.Img
+	}
+	// kept returns the ratio of the source pixels, checking that every pixel is
+	// either the source or the backdrop, without any interpolation between them.
+	kept := func(img *image.NRGBA, want color.NRGBA) float64 {
+		var n int
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				switch c := img.NRGBAAt(x, y); c {
+				case want:
+					n++
+				case dstColor:
+				default:
+					t.Fatalf("unexpected color %v at (%d, %d)", c, x, y)
+				}
+			}
+		}
+		return float64(n) / float64(rect.Dx()*rect.Dy())
+	}
+
+	imop.SetOpacity(1)
+	assert.Equal(1.0, kept(dissolve(source), srcColor))
+	imop.SetOpacity(0)
+	assert.Equal(0.0, kept(dissolve(source), srcColor))
+
+	// The opacity is the probability of keeping a source pixel.
+	for _, opacity := range []float64{0.25, 0.5, 0.75} {
+		imop.SetOpacity(opacity)
+		assert.InDelta(opacity, kept(dissolve(source), srcColor), 0.02)
+	}
+
+	// The alpha of the source is dissolved too, the kept pixels being fully opaque.
+	imop.SetOpacity(0.5)
+	semi := image.NewUniform(color.NRGBA{R: 214, G: 20, B: 65, A: 128})
+	assert.InDelta(0.25, kept(dissolve(semi), srcColor), 0.02)
+
+	// The output is reproducible with the same seed, whatever the number of workers.
+	out := dissolve(source)
+	assert.Equal(out.Pix, dissolve(source).Pix)
+	imop.SetWorkers(4)
+	assert.Equal(out.Pix, dissolve(source).Pix)
+
+	blop.SetSeed(43)
+	assert.NotEqual(out.Pix, dissolve(source).Pix)
+}
+
+func TestBlend_SetSat(t *testing.T) {
+	assert := assert.New(t)
+
+	// setSatSorted is the straightforward implementation of SetSat,
+	// sorting the channels to find the minimum, middle and maximum ones.
+	setSatSorted := func(rgb Color, s float64) Color {
+		c := []*float64{&rgb.R, &rgb.G, &rgb.B}
+		sort.SliceStable(c, func(i, j int) bool { return *c[i] < *c[j] })
+		if *c[2] > *c[0] {
+			*c[1] = ((*c[1] - *c[0]) * s) / (*c[2] - *c[0])
+			*c[2] = s
+		} else {
+			*c[1], *c[2] = 0, 0
+		}
+		*c[0] = 0
+		return rgb
+	}
+
+	blop := NewBlend()
+	values := []float64{0, 0.1, 0.25, 0.5, 0.5, 0.75, 1}
+	for _, r := range values {
+		for _, g := range values {
+			for _, b := range values {
+				c := Color{R: r, G: g, B: b}
+				for _, s := range []float64{0, 0.3, 1} {
+					assert.InDelta(setSatSorted(c, s).R, blop.SetSat(c, s).R, 1e-12, "%v, %v", c, s)
+					assert.InDelta(setSatSorted(c, s).G, blop.SetSat(c, s).G, 1e-12, "%v, %v", c, s)
+					assert.InDelta(setSatSorted(c, s).B, blop.SetSat(c, s).B, 1e-12, "%v, %v", c, s)
+				}
+				assert.InDelta(blop.Sat(c), blop.Sat(blop.SetSat(c, blop.Sat(c))), 1e-12)
+			}
+		}
+	}
+	assert.Equal(Color{R: 0, G: 0.5, B: 0.25}, blop.SetSat(Color{R: 0.25, G: 1, B: 0.625}, 0.5))
+
+	c := Color{R: 0.8, G: 0.1, B: 0.3}
+	allocs := testing.AllocsPerRun(100, func() {
+		c = blop.SetLum(blop.SetSat(c, blop.Sat(c)), blop.Lum(c))
+		c = blop.clip(c)
+	})
+	assert.Zero(allocs)
+}
+
+func BenchmarkBlend_NonSeparable(b *testing.B) {
+	rect := image.Rect(0, 0, 512, 512)
+	source := makeTestImage(rect, 1)
+	backdrop := makeTestImage(rect, 2)
+	bmp := NewBitmap(rect)
+
+	imop := InitOp()
+	imop.SetWorkers(1)
+	blop := NewBlend()
+
+	for _, mode := range []BlendMode{Hue, Saturation, ColorMode, Luminosity} {
+		b.Run(string(mode), func(b *testing.B) {
+			blop.Set(mode)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				imop.Draw(bmp, source, backdrop, blop)
+			}
+		})
+	}
+}
+
+func BenchmarkBlend_SetSat(b *testing.B) {
+	blop := NewBlend()
+	colors := []Color{
+		{R: 0.8, G: 0.1, B: 0.3},
+		{R: 0.2, G: 0.9, B: 0.5},
+		{R: 0.4, G: 0.4, B: 0.7},
+		{R: 1, G: 0.5, B: 0},
+	}
+	var res Color
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := colors[i%len(colors)]
+		res = blop.SetLum(blop.SetSat(c, blop.Sat(colors[(i+1)%len(colors)])), blop.Lum(c))
+	}
+	_ = res
 }
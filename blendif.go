@@ -0,0 +1,89 @@
+package gomp
+
+import "fmt"
+
+// BlendRange is a range of values with split black and white points, as the Blend If sliders
+// of Photoshop. The values below Black[0] and above White[1] are hidden, the ones between
+// Black[1] and White[0] are fully visible, while the values between the split points of
+// the black and of the white point are smoothly weighted.
+type BlendRange struct {
+	Black [2]float64
+	White [2]float64
+}
+
+// FullRange is the blend range keeping all the values visible.
+var FullRange = BlendRange{Black: [2]float64{0, 0}, White: [2]float64{1, 1}}
+
+// BlendIf hides parts of the source or reveals the backdrop, depending on the values of
+// the source and of the backdrop pixels. Channel selects the evaluated channel, which is
+// one of RedChannel, GreenChannel and BlueChannel, the zero value meaning the luminosity
+// computed by Blend.Lum. Source and Backdrop are the ranges of the visible values.
+type BlendIf struct {
+	Channel  Channel
+	Source   BlendRange
+	Backdrop BlendRange
+}
+
+// SetBlendIf changes the Blend If ranges evaluated per pixel by the drawing methods.
+// A nil value disables them. In the gamma-correct mode the ranges apply to the linear values.
+func (bl *Blend) SetBlendIf(bi *BlendIf) error {
+	if bi != nil {
+		switch bi.Channel {
+		case 0, RedChannel, GreenChannel, BlueChannel:
+		default:
+			return fmt.Errorf("the blend if channel should be red, green, blue or none for the luminosity")
+		}
+		if !bi.Source.valid() || !bi.Backdrop.valid() {
+			return fmt.Errorf("the blend if points should be increasing values in the [0, 1] range")
+		}
+	}
+	bl.If = bi
+	return nil
+}
+
+// valid reports whether the points of the range are in increasing order, inside the [0, 1] range.
+func (r BlendRange) valid() bool {
+	pts := [...]float64{0, r.Black[0], r.Black[1], r.White[0], r.White[1], 1}
+	for i := 1; i < len(pts); i++ {
+		if pts[i] < pts[i-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// weight returns the visibility of a value, between 0 (hidden) and 1 (fully visible).
+func (r BlendRange) weight(v float64) float64 {
+	switch {
+	case v < r.Black[0] || v > r.White[1]:
+		return 0
+	case v < r.Black[1]:
+		return (v - r.Black[0]) / (r.Black[1] - r.Black[0])
+	case v > r.White[0]:
+		return (r.White[1] - v) / (r.White[1] - r.White[0])
+	}
+	return 1
+}
+
+// weight returns the factor scaling the coverage of the alpha-premultiplied source pixel.
+func (bi *BlendIf) weight(bl *Blend, src, dst Pixel) float64 {
+	w := bi.Source.weight(bi.value(bl, src))
+	if w == 0 {
+		return 0
+	}
+	return w * bi.Backdrop.weight(bi.value(bl, dst))
+}
+
+// value returns the evaluated channel of an alpha-premultiplied pixel.
+func (bi *BlendIf) value(bl *Blend, p Pixel) float64 {
+	c := p.unpremultiply()
+	switch bi.Channel {
+	case RedChannel:
+		return c.R
+	case GreenChannel:
+		return c.G
+	case BlueChannel:
+		return c.B
+	}
+	return bl.Lum(Color{R: c.R, G: c.G, B: c.B})
+}
@@ -0,0 +1,129 @@
+package gomp
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlendIf_Basic(t *testing.T) {
+	assert := assert.New(t)
+
+	blop := NewBlend()
+	assert.Nil(blop.If)
+	assert.NoError(blop.SetBlendIf(&BlendIf{Source: FullRange, Backdrop: FullRange}))
+	assert.NotNil(blop.If)
+	assert.NoError(blop.SetBlendIf(nil))
+	assert.Nil(blop.If)
+
+	assert.Error(blop.SetBlendIf(&BlendIf{Channel: AlphaChannel, Source: FullRange, Backdrop: FullRange}))
+	assert.Error(blop.SetBlendIf(&BlendIf{Channel: RedChannel | GreenChannel, Source: FullRange, Backdrop: FullRange}))
+	// The black point cannot be past the white point.
+	assert.Error(blop.SetBlendIf(&BlendIf{
+		Source:   BlendRange{Black: [2]float64{0.2, 0.6}, White: [2]float64{0.5, 1}},
+		Backdrop: FullRange,
+	}))
+	assert.Error(blop.SetBlendIf(&BlendIf{
+		Source:   BlendRange{Black: [2]float64{0, 0}, White: [2]float64{1, 1.5}},
+		Backdrop: FullRange,
+	}))
+	assert.Nil(blop.If)
+}
+
+func TestBlendIf_Weight(t *testing.T) {
+	assert := assert.New(t)
+
+	r := BlendRange{Black: [2]float64{0.2, 0.4}, White: [2]float64{0.6, 1}}
+	for _, tt := range []struct {
+		v, w float64
+	}{
+		{0, 0}, {0.2, 0}, {0.3, 0.5}, {0.4, 1}, {0.5, 1}, {0.6, 1}, {0.7, 0.75}, {0.9, 0.25}, {1, 0},
+	} {
+		assert.InDeltaf(tt.w, r.weight(tt.v), 1e-9, "weight of %v", tt.v)
+	}
+
+	// The points which are not split act as hard thresholds.
+	r = BlendRange{Black: [2]float64{0.5, 0.5}, White: [2]float64{1, 1}}
+	assert.Equal(0.0, r.weight(0.49))
+	assert.Equal(1.0, r.weight(0.5))
+	assert.Equal(1.0, FullRange.weight(0))
+	assert.Equal(1.0, FullRange.weight(1))
+}
+
+func TestBlendIf_Draw(t *testing.T) {
+	assert := assert.New(t)
+
+	// A horizontal gray gradient as backdrop and an opaque red source over it.
+	rect := image.Rect(0, 0, 256, 1)
+	backdrop := image.NewNRGBA(rect)
+	for x := 0; x < 256; x++ {
+		backdrop.SetNRGBA(x, 0, color.NRGBA{R: uint8(x), G: uint8(x), B: uint8(x), A: 255})
+	}
+	source := image.NewUniform(color.NRGBA{R: 255, A: 255})
+
+	imop := InitOp()
+	blop := NewBlend()
+	blop.Set(Normal)
+
+	// The source is overlaid only on the highlights of the backdrop,
+	// with a smooth transition between 0.5 and 0.7.
+	blop.SetBlendIf(&BlendIf{
+		Source:   FullRange,
+		Backdrop: BlendRange{Black: [2]float64{0.5, 0.7}, White: [2]float64{1, 1}},
+	})
+	bmp := NewBitmap(rect)
+	imop.DrawAt(bmp, rect, source, image.Point{}, backdrop, image.Point{}, blop)
+
+	for x := 0; x < 256; x++ {
+		v := float64(x) / 255
+		w := Min(1, Max(0, (v-0.5)/0.2))
+		expected := color.NRGBA{
+			R: uint8((1-w)*float64(x) + w*255),
+			G: uint8((1 - w) * float64(x)),
+			B: uint8((1 - w) * float64(x)),
+			A: 255,
+		}
+		got := bmp.Img.NRGBAAt(x, 0)
+		if !assert.Truef(compareBytes([]uint8{expected.R, expected.G, expected.B, 255}, []uint8{got.R, got.G, got.B, got.A}, 1),
+			"pixel %d: expected %v, got %v", x, expected, got) {
+			break
+		}
+	}
+	assert.Equal(color.NRGBA{R: 100, G: 100, B: 100, A: 255}, bmp.Img.NRGBAAt(100, 0))
+	assert.Equal(color.NRGBA{R: 255, A: 255}, bmp.Img.NRGBAAt(200, 0))
+}
+
+func TestBlendIf_Channel(t *testing.T) {
+	assert := assert.New(t)
+
+	rect := image.Rect(0, 0, 1, 1)
+	draw := func(blop *Blend, src, dst color.NRGBA) []uint8 {
+		bmp := NewBitmap(rect)
+		InitOp().DrawAt(bmp, rect, image.NewUniform(src), image.Point{}, image.NewUniform(dst), image.Point{}, blop)
+		return bmp.Img.Pix
+	}
+	dst := color.NRGBA{R: 20, G: 40, B: 60, A: 255}
+	// A dark blue source, with a high blue channel but a low luminosity.
+	src := color.NRGBA{R: 0, G: 0, B: 230, A: 255}
+
+	blop := NewBlend()
+	blop.Set(Multiply)
+	hideDark := BlendRange{Black: [2]float64{0.5, 0.5}, White: [2]float64{1, 1}}
+
+	// The luminosity of the source is below the black point, so the source is hidden.
+	blop.SetBlendIf(&BlendIf{Source: hideDark, Backdrop: FullRange})
+	assert.Equal([]uint8{20, 40, 60, 255}, draw(blop, src, dst))
+
+	// Its blue channel is above the black point, so the source is kept.
+	blop.SetBlendIf(&BlendIf{Channel: BlueChannel, Source: hideDark, Backdrop: FullRange})
+	assert.Equal([]uint8{0, 0, 54, 255}, draw(blop, src, dst))
+
+	// The luminosity follows the coefficients of the blend.
+	green := color.NRGBA{R: 0, G: 170, B: 0, A: 255}
+	blop.SetBlendIf(&BlendIf{Source: BlendRange{Black: [2]float64{0.45, 0.45}, White: [2]float64{1, 1}}, Backdrop: FullRange})
+	assert.Equal([]uint8{20, 40, 60, 255}, draw(blop, green, dst))
+	blop.SetLumCoeffs(Rec709Lum)
+	assert.Equal([]uint8{0, 27, 0, 255}, draw(blop, green, dst))
+}
@@ -0,0 +1,48 @@
+package gomp
+
+import "fmt"
+
+// Channel is a bit mask selecting the channels written by the drawing methods.
+type Channel uint8
+
+const (
+	RedChannel Channel = 1 << iota
+	GreenChannel
+	BlueChannel
+	AlphaChannel
+
+	RGBChannels = RedChannel | GreenChannel | BlueChannel
+	AllChannels = RGBChannels | AlphaChannel
+)
+
+// SetChannels restricts the result of the composition to the selected channels, the backdrop
+// being passed through for the other ones. The channels are selected on the non-premultiplied
+// values, so for example the red channel of a texture can be packed into another one without
+// altering its alpha, while AlphaChannel merges only the alpha, keeping the backdrop colors.
+func (op *Comp) SetChannels(c Channel) error {
+	if c == 0 || c&^AllChannels != 0 {
+		return fmt.Errorf("invalid channel mask")
+	}
+	op.Channels = c
+	return nil
+}
+
+// apply returns the non-premultiplied result of the composition with the channels not selected
+// by the mask taken from the non-premultiplied backdrop dst, so that the colors of the transparent
+// backdrop pixels are kept.
+func (c Channel) apply(res, d Pixel) Pixel {
+	r := res.unpremultiply()
+	if c&RedChannel == 0 {
+		r.R = d.R
+	}
+	if c&GreenChannel == 0 {
+		r.G = d.G
+	}
+	if c&BlueChannel == 0 {
+		r.B = d.B
+	}
+	if c&AlphaChannel == 0 {
+		r.A = d.A
+	}
+	return r
+}
@@ -0,0 +1,126 @@
+package gomp
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannel_Basic(t *testing.T) {
+	assert := assert.New(t)
+
+	imop := InitOp()
+	assert.Equal(AllChannels, imop.Channels)
+	assert.Error(imop.SetChannels(0))
+	assert.Error(imop.SetChannels(AllChannels + 1))
+	assert.NoError(imop.SetChannels(RedChannel | AlphaChannel))
+	assert.Equal(RedChannel|AlphaChannel, imop.Channels)
+}
+
+func TestChannel_Draw(t *testing.T) {
+	assert := assert.New(t)
+
+	rect := image.Rect(0, 0, 1, 1)
+	draw := func(imop *Comp, bl *Blend, src, dst color.NRGBA) []uint8 {
+		bmp := NewBitmap(rect)
+		imop.DrawAt(bmp, rect, image.NewUniform(src), image.Point{}, image.NewUniform(dst), image.Point{}, bl)
+		return bmp.Img.Pix
+	}
+	src := color.NRGBA{R: 200, G: 100, B: 50, A: 255}
+	dst := color.NRGBA{R: 10, G: 20, B: 30, A: 128}
+
+	imop := InitOp()
+	imop.Set(Copy)
+
+	// Packing a single channel of the source into the backdrop, keeping its alpha.
+	imop.SetChannels(RedChannel)
+	assert.Equal([]uint8{200, 20, 30, 128}, draw(imop, nil, src, dst))
+	imop.SetChannels(GreenChannel | BlueChannel)
+	assert.Equal([]uint8{10, 100, 50, 128}, draw(imop, nil, src, dst))
+
+	// Merging only the alpha keeps the colors of the backdrop.
+	imop.Set(SrcOver)
+	imop.SetChannels(AlphaChannel)
+	half := color.NRGBA{R: 200, G: 100, B: 50, A: 128}
+	assert.True(compareBytes([]uint8{10, 20, 30, 191}, draw(imop, nil, half, dst), 1))
+
+	// The channel mask applies to the result of the blend modes too.
+	blop := NewBlend()
+	blop.Set(Multiply)
+	dst.A = 255
+	imop.SetChannels(RGBChannels &^ BlueChannel)
+	assert.True(compareBytes([]uint8{7, 7, 30, 255}, draw(imop, blop, src, dst), 1))
+
+	// Selecting all the channels is the same as not masking at all.
+	imop.SetChannels(AllChannels)
+	masked := draw(imop, blop, half, dst)
+	imop.Channels = 0
+	assert.Equal(masked, draw(imop, blop, half, dst))
+}
+
+func TestChannel_TransparentBackdrop(t *testing.T) {
+	assert := assert.New(t)
+
+	rect := image.Rect(0, 0, 1, 1)
+	src := color.NRGBA{R: 200, G: 100, B: 50, A: 200}
+	dst := color.NRGBA{R: 10, G: 20, B: 30, A: 0}
+	draw := func(imop *Comp, out draw.Image, bg image.Image) {
+		imop.DrawAt(NewBitmapFrom(out), rect, image.NewUniform(src), image.Point{}, bg, image.Point{}, nil)
+	}
+
+	imop := InitOp()
+	imop.Set(Copy)
+
+	// Copying the alpha alone keeps the colors of a transparent backdrop.
+	imop.SetChannels(AlphaChannel)
+	img := image.NewNRGBA(rect)
+	img.Pix = []uint8{dst.R, dst.G, dst.B, dst.A}
+	draw(imop, img, img)
+	assert.Equal([]uint8{10, 20, 30, 200}, img.Pix)
+
+	// Packing the color channels into a transparent texture keeps them as well.
+	imop.SetChannels(RedChannel)
+	img = image.NewNRGBA(rect)
+	draw(imop, img, image.NewUniform(dst))
+	assert.Equal([]uint8{200, 20, 30, 0}, img.Pix)
+
+	imop.SetChannels(RGBChannels)
+	img = image.NewNRGBA(rect)
+	draw(imop, img, image.NewUniform(dst))
+	assert.Equal([]uint8{200, 100, 50, 0}, img.Pix)
+
+	img64 := image.NewNRGBA64(rect)
+	draw(imop, img64, image.NewUniform(dst))
+	assert.Equal(color.NRGBA64{R: 200 * 0x101, G: 100 * 0x101, B: 50 * 0x101}, img64.NRGBA64At(0, 0))
+
+	// The same holds in the linear color space.
+	imop.SetLinear(true)
+	img = image.NewNRGBA(rect)
+	draw(imop, img, image.NewUniform(dst))
+	assert.Equal([]uint8{200, 100, 50, 0}, img.Pix)
+}
+
+func TestChannel_Draw16(t *testing.T) {
+	assert := assert.New(t)
+
+	rect := image.Rect(0, 0, 32, 32)
+	src := makeTestImage(rect, 3)
+	dst := makeTestImage(rect, 5)
+
+	imop := InitOp()
+	imop.SetChannels(GreenChannel)
+
+	// The channels not selected are passed through from the backdrop,
+	// including the colors of its transparent pixels.
+	bmp := NewBitmapFrom(image.NewNRGBA64(rect))
+	imop.DrawAt(bmp, rect, src, image.Point{}, dst, image.Point{}, nil)
+	out := bmp.Image().(*image.NRGBA64)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		assert.EqualValues(dst.Pix[i], out.Pix[i*2])
+		assert.EqualValues(dst.Pix[i+2], out.Pix[i*2+4])
+		assert.EqualValues(dst.Pix[i+3], out.Pix[i*2+6])
+	}
+}
@@ -8,35 +8,62 @@ package gomp
 import (
 	"fmt"
 	"image"
-	"image/color"
-	"math"
+	"image/draw"
+	"runtime"
+	"sync"
 )
 
+// CompositeOp is the name of a Porter-Duff composition operation.
+type CompositeOp string
+
 const (
-	Clear   = "clear"
-	Copy    = "copy"
-	Dst     = "dst"
-	SrcOver = "src_over"
-	DstOver = "dst_over"
-	SrcIn   = "src_in"
-	DstIn   = "dst_in"
-	SrcOut  = "src_out"
-	DstOut  = "dst_out"
-	SrcAtop = "src_atop"
-	DstAtop = "dst_atop"
-	Xor     = "xor"
+	Clear   CompositeOp = "clear"
+	Copy    CompositeOp = "copy"
+	Dst     CompositeOp = "dst"
+	SrcOver CompositeOp = "src_over"
+	DstOver CompositeOp = "dst_over"
+	SrcIn   CompositeOp = "src_in"
+	DstIn   CompositeOp = "dst_in"
+	SrcOut  CompositeOp = "src_out"
+	DstOut  CompositeOp = "dst_out"
+	SrcAtop CompositeOp = "src_atop"
+	DstAtop CompositeOp = "dst_atop"
+	Xor     CompositeOp = "xor"
+
+	// Operators provided by Canvas 2D, Skia, Cairo and Android besides the Porter-Duff ones.
+	Plus       CompositeOp = "plus"
+	Lighter                = Plus
+	PlusDarker CompositeOp = "plus_darker"
+	Saturate   CompositeOp = "saturate"
+	Modulate   CompositeOp = "modulate"
 )
 
+// CompositeFunc computes the result of a composition operation for a single pixel.
+// The source and destination pixels, as well as the returned pixel, are alpha-premultiplied.
+type CompositeFunc func(src, dst Pixel) Pixel
+
 // Bitmap holds an image type as a placeholder for the Porter-Duff composition
 // operations which can be used as a source or destination image.
+// Img is the non-premultiplied 8-bit image created by NewBitmap, and it's nil
+// if the bitmap has been created from another image type by NewBitmapFrom.
 type Bitmap struct {
 	Img *image.NRGBA
+	img draw.Image
 }
 
 // Comp struct contains the currently active composition operation and all the supported operations.
+// Opacity is the global opacity of the source, ranging from 0 (fully transparent) to 1 (fully opaque).
+// Workers is the number of goroutines used for drawing, zero meaning runtime.GOMAXPROCS.
+// Linear enables the gamma-correct compositing, see SetLinear.
+// Channels selects the channels written by the drawing methods, zero meaning all of them, see SetChannels.
 type Comp struct {
-	CurrentOp string
-	Ops       []string
+	CurrentOp CompositeOp
+	Ops       []CompositeOp
+	Opacity   float64
+	Workers   int
+	Linear    bool
+	Channels  Channel
+	funcs     map[CompositeOp]CompositeFunc
 }
 
 // NewBitmap initializes a new Bitmap.
@@ -46,422 +73,583 @@ func NewBitmap(rect image.Rectangle) *Bitmap {
 	}
 }
 
+// NewBitmapFrom initializes a new Bitmap drawing directly into the provided image.
+// The *image.NRGBA and *image.RGBA images are accessed directly through their
+// Pix slice, the alpha-premultiplied *image.RGBA images being composited
+// without any conversion to and from the non-premultiplied form.
+func NewBitmapFrom(img draw.Image) *Bitmap {
+	if nrgba, ok := img.(*image.NRGBA); ok {
+		return &Bitmap{Img: nrgba}
+	}
+	return &Bitmap{img: img}
+}
+
+// Image returns the image the bitmap draws into.
+func (bmp *Bitmap) Image() draw.Image {
+	if bmp.Img != nil {
+		return bmp.Img
+	}
+	return bmp.img
+}
+
 // InitOp initializes a new composition operation.
 func InitOp() *Comp {
-	return &Comp{
+	op := &Comp{
 		CurrentOp: SrcOver,
-		Ops: []string{
-			Clear,
-			Copy,
-			Dst,
-			SrcOver,
-			DstOver,
-			SrcIn,
-			DstIn,
-			SrcOut,
-			DstOut,
-			SrcAtop,
-			DstAtop,
-			Xor,
-		},
+		Opacity:   1,
+		Channels:  AllChannels,
+		funcs:     make(map[CompositeOp]CompositeFunc),
 	}
+	for _, c := range []struct {
+		name CompositeOp
+		fn   CompositeFunc
+	}{
+		{Clear, opClear},
+		{Copy, opCopy},
+		{Dst, opDst},
+		{SrcOver, opSrcOver},
+		{DstOver, opDstOver},
+		{SrcIn, opSrcIn},
+		{DstIn, opDstIn},
+		{SrcOut, opSrcOut},
+		{DstOut, opDstOut},
+		{SrcAtop, opSrcAtop},
+		{DstAtop, opDstAtop},
+		{Xor, opXor},
+		{Plus, opPlus},
+		{PlusDarker, opPlusDarker},
+		{Saturate, opSaturate},
+		{Modulate, opModulate},
+	} {
+		op.Register(c.name, c.fn)
+	}
+	return op
+}
+
+// Register adds a custom composition operation under the provided name, which
+// can be activated afterwards with Set. Registering an already existing name
+// replaces its implementation.
+func (op *Comp) Register(name CompositeOp, fn CompositeFunc) error {
+	if name == "" {
+		return fmt.Errorf("missing composition operation name")
+	}
+	if fn == nil {
+		return fmt.Errorf("missing composition function for %q", name)
+	}
+	if op.funcs == nil {
+		op.funcs = make(map[CompositeOp]CompositeFunc)
+	}
+	if _, ok := op.funcs[name]; !ok {
+		op.Ops = append(op.Ops, name)
+	}
+	op.funcs[name] = fn
+
+	return nil
 }
 
 // Set changes the current composition operation.
-func (op *Comp) Set(cop string) error {
-	if Contains(op.Ops, cop) {
+func (op *Comp) Set(cop CompositeOp) error {
+	if _, ok := op.funcs[cop]; ok {
 		op.CurrentOp = cop
 		return nil
 	}
 	return fmt.Errorf("unsupported composition operation")
 }
 
-// Set changes the current composition operation.
-func (op *Comp) Get() string {
+// Get returns the current composition operation.
+func (op *Comp) Get() CompositeOp {
 	return op.CurrentOp
 }
 
+// SetOpacity changes the global opacity applied on the source. The opacity
+// should be a value between 0 (fully transparent) and 1 (fully opaque).
+func (op *Comp) SetOpacity(opacity float64) error {
+	if opacity < 0 || opacity > 1 {
+		return fmt.Errorf("opacity should be in the [0, 1] range")
+	}
+	op.Opacity = opacity
+	return nil
+}
+
+// SetWorkers changes the number of goroutines used for drawing. The image is split into
+// horizontal bands processed concurrently, the output being identical to the serial one.
+// Zero means runtime.GOMAXPROCS, while 1 disables the concurrent processing.
+// With a single worker the drawing methods don't allocate any memory, while the concurrent
+// drawing allocates only the goroutines of the bands, independently of the size of the images.
+func (op *Comp) SetWorkers(n int) error {
+	if n < 0 {
+		return fmt.Errorf("the number of workers cannot be negative")
+	}
+	op.Workers = n
+	return nil
+}
+
+// SetLinear enables or disables the gamma-correct compositing. When enabled, the sRGB encoded
+// images are decoded into linear light before the composition operation and the blend mode
+// are applied, and the result is encoded back into sRGB. This avoids the darkened edges and
+// the muddy transitions of the compositing done directly on the sRGB values.
+// The *FloatRGBA images are considered to already hold linear values, so they are not converted;
+// use NRGBAToLinearFloat and LinearFloatToNRGBA to convert them from and into 8-bit sRGB images.
+func (op *Comp) SetLinear(linear bool) {
+	op.Linear = linear
+}
+
 // Draw applies the currently active Ported-Duff composition operation formula,
 // taking as parameter the source and the destination image and draws the result into the bitmap.
-// If a blend mode is activated it will plug in the alpha blending formula also into the equation.
+// If a blend mode is activated, the source color is first mixed with the backdrop by the blend
+// mode, then the result is composited with the backdrop by the composition operation.
 func (op *Comp) Draw(bitmap *Bitmap, src, dst *image.NRGBA, bl *Blend) {
-	dx, dy := src.Bounds().Dx(), src.Bounds().Dy()
+	op.DrawAt(bitmap, bitmap.Image().Bounds(), src, src.Bounds().Min, dst, dst.Bounds().Min, bl)
+}
+
+// DrawRGBA is the variant of Draw working with alpha-premultiplied source and destination images.
+// Combined with a bitmap created from an *image.RGBA, the composition operations are computed
+// in the premultiplied space as defined in the Porter-Duff paper, without any intermediary conversion.
+func (op *Comp) DrawRGBA(bitmap *Bitmap, src, dst *image.RGBA, bl *Blend) {
+	op.DrawAt(bitmap, bitmap.Image().Bounds(), src, src.Bounds().Min, dst, dst.Bounds().Min, bl)
+}
 
+// DrawAt is the generalized version of Draw and it follows the semantics of draw.Draw from
+// the standard library: r.Min in bitmap is aligned with sp in src and with dp in dst, then
+// the result of the composition is drawn into the r rectangle of the bitmap.
+// The rectangle is clipped to the bounds of the bitmap, the source and the destination image,
+// the pixels of the bitmap outside of the clipped rectangle being left untouched.
+// The destination image can be the bitmap image itself, in which case the composition happens in place.
+func (op *Comp) DrawAt(
+	bitmap *Bitmap,
+	r image.Rectangle,
+	src image.Image,
+	sp image.Point,
+	dst image.Image,
+	dp image.Point,
+	bl *Blend,
+) {
+	op.DrawMask(bitmap, r, src, sp, dst, dp, nil, image.Point{}, bl)
+}
+
+// DrawMask works like DrawAt, but it limits the coverage of the source image with a mask,
+// the equivalent of draw.DrawMask. The mask point mp is aligned with r.Min, and the alpha
+// channel of the mask scales the alpha of the source before the composition operation
+// and the blend mode is applied. A nil mask is treated as fully opaque.
+//
+// The global opacity scales the alpha of the source before the composition operation is applied,
+// so with the source-over operator the result is the one defined by the W3C compositing formula:
+// co = cs x opacity + cb x (1 - αs x opacity).
+//
+// The steps are applied for every pixel in the following order: the mask and the Blend If ranges
+// limit the coverage of the source, the fill opacity fades the source of the special blend modes,
+// the blend mode mixes the source with the backdrop, the layer opacity of the blend and the global
+// opacity scale the alpha of the mixed source, and finally the composition operation is applied.
+func (op *Comp) DrawMask(
+	bitmap *Bitmap,
+	r image.Rectangle,
+	src image.Image,
+	sp image.Point,
+	dst image.Image,
+	dp image.Point,
+	mask image.Image,
+	mp image.Point,
+	bl *Blend,
+) {
+	out := bitmap.Image()
+	clip(out, &r, src, &sp, dst, &dp, mask, &mp)
+	if r.Empty() {
+		return
+	}
+
+	// Drawing in place with shifted source or destination points makes the output depend on
+	// the processing order. The rows are processed backward when the pixels would otherwise be
+	// overwritten before being read, like image/draw does, and if the source and the backdrop
+	// need opposite orders, the source is copied first.
+	ss, ds := shift(src, out, sp, r.Min), shift(dst, out, dp, r.Min)
+	if ss*ds < 0 {
+		src, ss = snapshot(src, r.Add(sp.Sub(r.Min))), 0
+	}
+
+	dc := &drawCall{
+		out:     out,
+		r:       r,
+		src:     src,
+		sp:      sp,
+		dst:     dst,
+		dp:      dp,
+		mask:    mask,
+		mp:      mp,
+		bl:      bl,
+		compFn:  op.funcs[op.CurrentOp],
+		opacity: op.Opacity,
+		linear:  op.Linear,
+		masked:  op.Channels != 0 && op.Channels != AllChannels,
+		chans:   op.Channels,
+
+		backward: ss < 0 || ds < 0,
+	}
+	if bl != nil {
+		if op.Linear && bl.Model == OKLChModel && bl.Space == RGBSpace {
+			// The OKLCh model has to convert the colors from linear light instead of sRGB.
+			lb := *bl
+			lb.linear = true
+			dc.bl = &lb
+		}
+		dc.blendFn = bl.funcs[bl.Current]
+		dc.blendIf = bl.If
+		dc.opacity *= bl.Opacity
+		// The fill opacity is applied inside the special blend modes, while for the other
+		// ones, and for every blend mode in the OKLab space, it's the same as the layer opacity.
+		if fn, ok := fillModes[bl.Current]; ok && bl.Fill < 1 && bl.Space != OKLabSpace {
+			dc.fillFn, dc.fill = fn, bl.Fill
+		} else {
+			dc.opacity *= bl.Fill
+		}
+		if bl.Current == Dissolve {
+			// The opacity decides which pixels of the source are kept, instead of scaling their alpha.
+			dc.dissolve, dc.density, dc.opacity = true, dc.opacity, 1
+			dc.seed = uint64(bl.Seed)
+		}
+	}
+	if dc.linear {
+		initGammaTables()
+	}
+
+	workers := op.Workers
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if ss != 0 || ds != 0 {
+		workers = 1
+	}
+	workers = Min(workers, r.Dy())
+
+	if workers == 1 {
+		dc.rows(r.Min.Y, r.Max.Y)
+		return
+	}
+	dc.parallel(workers)
+}
+
+// drawCall holds the parameters of a drawing operation, shared between the workers.
+type drawCall struct {
+	out     draw.Image
+	r       image.Rectangle
+	src     image.Image
+	sp      image.Point
+	dst     image.Image
+	dp      image.Point
+	mask    image.Image
+	mp      image.Point
+	bl      *Blend
+	compFn  CompositeFunc
+	blendFn BlendFunc
+	blendIf *BlendIf
+	fillFn  fillFunc
+	fill    float64
+	opacity float64
+	linear  bool
+	masked  bool
+	chans   Channel
+
+	// backward processes the rows from the bottom to the top and from the right to the left.
+	backward bool
+
+	// The parameters of the dissolve blend mode.
+	dissolve bool
+	density  float64
+	seed     uint64
+}
+
+// parallel splits the clipped rectangle into horizontal bands drawn concurrently.
+// It takes the drawCall by value, so that only the concurrent calls have to move it on the heap.
+func (dc drawCall) parallel(workers int) {
+	r := dc.r
+	band := (r.Dy() + workers - 1) / workers
+
+	var wg sync.WaitGroup
+	for y := r.Min.Y; y < r.Max.Y; y += band {
+		wg.Add(1)
+		go func(y0, y1 int) {
+			defer wg.Done()
+			dc.rows(y0, y1)
+		}(y, Min(y+band, r.Max.Y))
+	}
+	wg.Wait()
+}
+
+// rowChunk is the maximum number of pixels of a row decoded and composited at once.
+const rowChunk = 64
+
+// rows draws the rows of the clipped rectangle between y0 (inclusive) and y1 (exclusive).
+// The rows are processed in chunks of pixels, decoded into buffers allocated on the stack.
+func (dc *drawCall) rows(y0, y1 int) {
 	var (
-		r, g, b, a     uint32
-		rn, gn, bn, an float64
+		src, dst, res, raw [rowChunk]Pixel
+		cov                [rowChunk]float64
 	)
+	r := dc.r
+	chunks := (r.Dx() + rowChunk - 1) / rowChunk
 
-	for x := 0; x < dx; x++ {
-		for y := 0; y < dy; y++ {
-			r1, g1, b1, a1 := src.At(x, y).RGBA()
-			r2, g2, b2, a2 := dst.At(x, y).RGBA()
-
-			rs, gs, bs, as := r1>>8, g1>>8, b1>>8, a1>>8
-			rb, gb, bb, ab := r2>>8, g2>>8, b2>>8, a2>>8
-
-			// normalize the values.
-			rsn := float64(rs) / 255
-			gsn := float64(gs) / 255
-			bsn := float64(bs) / 255
-			asn := float64(as) / 255
-
-			rbn := float64(rb) / 255
-			gbn := float64(gb) / 255
-			bbn := float64(bb) / 255
-			abn := float64(ab) / 255
-
-			// applying the alpha composition formula
-			switch op.CurrentOp {
-			case Clear:
-				rn, gn, bn, an = 0, 0, 0, 0
-			case Copy:
-				rn = asn * rsn
-				gn = asn * gsn
-				bn = asn * bsn
-				an = asn * asn
-			case Dst:
-				rn = abn * rbn
-				gn = abn * gbn
-				bn = abn * bbn
-				an = abn * abn
-			case SrcOver:
-				rn = asn*rsn + abn*rbn*(1-asn)
-				gn = asn*gsn + abn*gbn*(1-asn)
-				bn = asn*bsn + abn*bbn*(1-asn)
-				an = asn + abn*(1-asn)
-			case DstOver:
-				rn = asn*rsn*(1-abn) + abn*rbn
-				gn = asn*gsn*(1-abn) + abn*gbn
-				bn = asn*bsn*(1-abn) + abn*bbn
-				an = asn*(1-abn) + abn
-			case SrcIn:
-				rn = asn * rsn * abn
-				gn = asn * gsn * abn
-				bn = asn * bsn * abn
-				an = asn * abn
-			case DstIn:
-				rn = abn * rbn * asn
-				gn = abn * gbn * asn
-				bn = abn * bbn * asn
-				an = abn * asn
-			case SrcOut:
-				rn = asn * rsn * (1 - abn)
-				gn = asn * gsn * (1 - abn)
-				bn = asn * bsn * (1 - abn)
-				an = asn * (1 - abn)
-			case DstOut:
-				rn = abn * rbn * (1 - asn)
-				gn = abn * gbn * (1 - asn)
-				bn = abn * bbn * (1 - asn)
-				an = abn * (1 - asn)
-			case SrcAtop:
-				rn = asn*rsn*abn + (1-asn)*abn*rbn
-				gn = asn*gsn*abn + (1-asn)*abn*gbn
-				bn = asn*bsn*abn + (1-asn)*abn*bbn
-				an = asn*abn + abn*(1-asn)
-			case DstAtop:
-				rn = asn*rsn*(1-abn) + abn*rbn*asn
-				gn = asn*gsn*(1-abn) + abn*gbn*asn
-				bn = asn*bsn*(1-abn) + abn*bbn*asn
-				an = asn*(1-abn) + abn*asn
-			case Xor:
-				rn = asn*rsn*(1-abn) + abn*rbn*(1-asn)
-				gn = asn*gsn*(1-abn) + abn*gbn*(1-asn)
-				bn = asn*bsn*(1-abn) + abn*bbn*(1-asn)
-				an = asn*(1-abn) + abn*(1-asn)
+	for k := 0; k < y1-y0; k++ {
+		y := y0 + k
+		if dc.backward {
+			y = y1 - 1 - k
+		}
+		sy := dc.sp.Y + y - r.Min.Y
+		dy := dc.dp.Y + y - r.Min.Y
+		my := dc.mp.Y + y - r.Min.Y
+
+		for c := 0; c < chunks; c++ {
+			x := r.Min.X + c*rowChunk
+			if dc.backward {
+				x = r.Min.X + (chunks-1-c)*rowChunk
+			}
+			n := Min(rowChunk, r.Max.X-x)
+			sx := dc.sp.X + x - r.Min.X
+			dx := dc.dp.X + x - r.Min.X
+			mx := dc.mp.X + x - r.Min.X
+
+			loadRow(dc.src, sx, sy, src[:n])
+			loadRow(dc.dst, dx, dy, dst[:n])
+			if dc.linear {
+				decodeRow(dc.src, src[:n])
+				decodeRow(dc.dst, dst[:n])
+			}
+			if dc.mask != nil {
+				loadAlphaRow(dc.mask, mx, my, cov[:n])
+				for i := 0; i < n; i++ {
+					src[i] = src[i].scale(cov[i])
+				}
+			}
+			if dc.blendIf != nil {
+				for i := 0; i < n; i++ {
+					src[i] = src[i].scale(dc.blendIf.weight(dc.bl, src[i], dst[i]))
+				}
+			}
+			if dc.dissolve {
+				for i := 0; i < n; i++ {
+					src[i] = dissolve(src[i], dc.density, dc.seed, x+i, y)
+				}
 			}
 
-			r = uint32(rn * 255)
-			g = uint32(gn * 255)
-			b = uint32(bn * 255)
-			a = uint32(an * 255)
-
-			bitmap.Img.Set(x, y, color.NRGBA{
-				R: uint8(r),
-				G: uint8(g),
-				B: uint8(b),
-				A: uint8(a),
-			})
-
-			// applying the blending mode
-			if bl != nil {
-				rn, gn, bn, an = 0, 0, 0, 0 // reset the colors
-				r1, g1, b1, a1 = src.At(x, y).RGBA()
-				r2, g2, b2, a2 = dst.At(x, y).RGBA()
-
-				rs, gs, bs, as = r1>>8, g1>>8, b1>>8, a1>>8
-				rb, gb, bb, ab = r2>>8, g2>>8, b2>>8, a2>>8
-
-				rsn = float64(rs) / 255
-				gsn = float64(gs) / 255
-				bsn = float64(bs) / 255
-				asn = float64(as) / 255
-
-				rbn = float64(rb) / 255
-				gbn = float64(gb) / 255
-				bbn = float64(bb) / 255
-				abn = float64(ab) / 255
-
-				foreground := Color{R: rsn, G: gsn, B: bsn}
-				background := Color{R: rbn, G: gbn, B: bbn}
-
-				switch bl.Current {
-				case Normal:
-					rn, gn, bn, an = rsn, gsn, bsn, asn
-				case Darken:
-					rn = Min(rsn, rbn)
-					gn = Min(gsn, gbn)
-					bn = Min(bsn, bbn)
-					an = Min(asn, abn)
-				case Lighten:
-					rn = Max(rsn, rbn)
-					gn = Max(gsn, gbn)
-					bn = Max(bsn, bbn)
-					an = Max(asn, abn)
-				case Screen:
-					rn = 1 - (1-rsn)*(1-rbn)
-					gn = 1 - (1-gsn)*(1-gbn)
-					bn = 1 - (1-bsn)*(1-bbn)
-					an = 1 - (1-asn)*(1-abn)
-				case Multiply:
-					rn = rsn * rbn
-					gn = gsn * gbn
-					bn = bsn * bbn
-					an = asn * abn
-				case Overlay:
-					if rsn <= 0.5 {
-						rn = 2 * rsn * rbn
-					} else {
-						rn = 1 - 2*(1-rsn)*(1-rbn)
-					}
-
-					if gsn <= 0.5 {
-						gn = 2 * gsn * gbn
-					} else {
-						gn = 1 - 2*(1-gsn)*(1-gbn)
-					}
-
-					if bsn <= 0.5 {
-						bn = 2 * bsn * bbn
-					} else {
-						bn = 1 - 2*(1-bsn)*(1-bbn)
-					}
-
-					if asn <= 0.5 {
-						an = 2 * asn * abn
-					} else {
-						an = 1 - 2*(1-asn)*(1-abn)
-					}
-				case SoftLight:
-					if rbn < 0.5 {
-						rn = rsn - (1-2*rbn)*rsn*(1-rsn)
-					} else {
-						var w3r float64
-						if rsn < 0.25 {
-							w3r = ((16*rsn-12)*rsn + 4) * rsn
-						} else {
-							w3r = math.Sqrt(rsn)
-						}
-						rn = rsn + (2*rbn-1)*(w3r-rsn)
-					}
-
-					if gbn < 0.5 {
-						gn = gsn - (1-2*gbn)*gsn*(1-gsn)
-					} else {
-						var w3g float64
-						if gsn < 0.25 {
-							w3g = ((16*gsn-12)*gsn + 4) * gsn
-						} else {
-							w3g = math.Sqrt(gsn)
-						}
-						gn = gsn + (2*gbn-1)*(w3g-gsn)
-					}
-
-					if bbn < 0.5 {
-						bn = bsn - (1-2*bbn)*bsn*(1-bsn)
-					} else {
-						var w3b float64
-						if bsn < 0.25 {
-							w3b = ((16*bsn-12)*bsn + 4) * bsn
-						} else {
-							w3b = math.Sqrt(bsn)
-						}
-						bn = bsn + (2*bbn-1)*(w3b-bsn)
-					}
-
-					if abn < 0.5 {
-						an = asn - (1-2*abn)*asn*(1-asn)
-					} else {
-						var w3a float64
-						if asn < 0.25 {
-							w3a = ((16*asn-12)*asn + 4) * asn
-						} else {
-							w3a = math.Sqrt(asn)
-						}
-						an = asn + (2*abn-1)*(w3a-asn)
-					}
-				case HardLight:
-					if rbn < 0.5 {
-						rn = rbn - (1-2*rsn)*rbn*(1-rbn)
-					} else {
-						var w3r float64
-						if rbn < 0.25 {
-							w3r = ((16*rbn-12)*rbn + 4) * rbn
-						} else {
-							w3r = math.Sqrt(rbn)
-						}
-						rn = rbn + (2*rsn-1)*(w3r-rbn)
-					}
-
-					if gbn < 0.5 {
-						gn = gbn - (1-2*gsn)*gbn*(1-gbn)
-					} else {
-						var w3g float64
-						if gbn < 0.25 {
-							w3g = ((16*gbn-12)*gbn + 4) * gbn
-						} else {
-							w3g = math.Sqrt(gbn)
-						}
-						gn = gbn + (2*gsn-1)*(w3g-gbn)
-					}
-
-					if bbn < 0.5 {
-						bn = bbn - (1-2*bsn)*bbn*(1-bbn)
-					} else {
-						var w3b float64
-						if bbn < 0.25 {
-							w3b = ((16*bbn-12)*bbn + 4) * bbn
-						} else {
-							w3b = math.Sqrt(bbn)
-						}
-						bn = bbn + (2*bsn-1)*(w3b-bbn)
-					}
-
-					if abn < 0.5 {
-						an = abn - (1-2*asn)*abn*(1-abn)
-					} else {
-						var w3a float64
-						if abn < 0.25 {
-							w3a = ((16*abn-12)*abn + 4) * abn
-						} else {
-							w3a = math.Sqrt(abn)
-						}
-						an = abn + (2*asn-1)*(w3a-abn)
-					}
-				case ColorDodge:
-					if rsn < 1 {
-						rn = Min(1, rbn/(1-rsn))
-					} else if rsn == 1 {
-						rn = 1
-					}
-
-					if gsn < 1 {
-						gn = Min(1, gbn/(1-gsn))
-					} else if gsn == 1 {
-						gn = 1
-					}
-
-					if bsn < 1 {
-						bn = Min(1, bbn/(1-bsn))
-					} else if bsn == 1 {
-						bn = 1
-					}
-
-					if asn < 1 {
-						an = Min(1, abn/(1-asn))
-					} else if asn == 1 {
-						an = 1
-					}
-				case ColorBurn:
-					if rsn > 0 {
-						rn = 1 - Min(1, (1-rbn)/rsn)
-					} else if rsn == 0 {
-						rn = 0
-					}
-
-					if gsn > 0 {
-						gn = 1 - Min(1, (1-gbn)/gsn)
-					} else if gsn == 0 {
-						gn = 0
-					}
-
-					if bsn > 0 {
-						bn = 1 - Min(1, (1-bbn)/bsn)
-					} else if bsn == 0 {
-						bn = 0
-					}
-
-					if asn > 0 {
-						an = 1 - Min(1, (1-abn)/asn)
-					} else if asn == 0 {
-						an = 0
-					}
-				case Difference:
-					rn = Abs(rbn - rsn)
-					gn = Abs(gbn - gsn)
-					bn = Abs(bbn - bsn)
-					an = 1
-				case Exclusion:
-					rn = rsn + rbn - 2*rsn*rbn
-					gn = gsn + gbn - 2*gsn*gbn
-					bn = bsn + bbn - 2*bsn*bbn
-					an = 1
-
-				// Non-separable blend modes
-				// https://www.w3.org/TR/compositing-1/#blendingnonseparable
-				case Hue:
-					sat := bl.SetSat(background, bl.Sat(foreground))
-					rgb := bl.SetLum(sat, bl.Lum(foreground))
-
-					a := asn + abn - asn*abn
-					rn = bl.AlphaCompose(abn, asn, a, rbn*255, rsn*255, rgb.R*255)
-					gn = bl.AlphaCompose(abn, asn, a, gbn*255, gsn*255, rgb.G*255)
-					bn = bl.AlphaCompose(abn, asn, a, bbn*255, bsn*255, rgb.B*255)
-					rn, gn, bn = rn/255, gn/255, bn/255
-					an = a
-				case Saturation:
-					sat := bl.SetSat(foreground, bl.Sat(background))
-					rgb := bl.SetLum(sat, bl.Lum(foreground))
-
-					a := asn + abn - asn*abn
-					rn = bl.AlphaCompose(abn, asn, a, rbn*255, rsn*255, rgb.R*255)
-					gn = bl.AlphaCompose(abn, asn, a, gbn*255, gsn*255, rgb.G*255)
-					bn = bl.AlphaCompose(abn, asn, a, bbn*255, bsn*255, rgb.B*255)
-					rn, gn, bn = rn/255, gn/255, bn/255
-					an = a
-				case ColorMode:
-					rgb := bl.SetLum(background, bl.Lum(foreground))
-
-					a := asn + abn - asn*abn
-					rn = bl.AlphaCompose(abn, asn, a, rbn*255, rsn*255, rgb.R*255)
-					gn = bl.AlphaCompose(abn, asn, a, gbn*255, gsn*255, rgb.G*255)
-					bn = bl.AlphaCompose(abn, asn, a, bbn*255, bsn*255, rgb.B*255)
-					rn, gn, bn = rn/255, gn/255, bn/255
-					an = a
-				case Luminosity:
-					rgb := bl.SetLum(foreground, bl.Lum(background))
-
-					a := asn + abn - asn*abn
-					rn = bl.AlphaCompose(abn, asn, a, rbn*255, rsn*255, rgb.R*255)
-					gn = bl.AlphaCompose(abn, asn, a, gbn*255, gsn*255, rgb.G*255)
-					bn = bl.AlphaCompose(abn, asn, a, bbn*255, bsn*255, rgb.B*255)
-					rn, gn, bn = rn/255, gn/255, bn/255
-					an = a
+			for i := 0; i < n; i++ {
+				res[i] = dc.composite(src[i], dst[i])
+			}
+			if dc.masked {
+				// The channels passed through are taken from the non-premultiplied backdrop,
+				// since the premultiplied one loses the colors of the transparent pixels.
+				loadStraightRow(dc.dst, dx, dy, raw[:n])
+				if dc.linear {
+					decodeStraightRow(dc.dst, raw[:n])
+				}
+				for i := 0; i < n; i++ {
+					res[i] = dc.chans.apply(res[i], raw[i])
 				}
+				storeStraightRow(dc.out, x, y, res[:n], dc.linear)
+				continue
 			}
+			storeRow(dc.out, x, y, res[:n], dc.linear)
+		}
+	}
+}
 
-			r = uint32(rn * 255)
-			g = uint32(gn * 255)
-			b = uint32(bn * 255)
-			a = uint32(an * 255)
-
-			bitmap.Img.Set(x, y, color.NRGBA{
-				R: uint8(r),
-				G: uint8(g),
-				B: uint8(b),
-				A: uint8(a),
-			})
+// composite computes the alpha-premultiplied result of the composition for a single pixel.
+// As defined by the W3C compositing model, the blend mode mixes the color of the source with
+// the backdrop, then the composition operation composites the mixed source with the backdrop.
+func (dc *drawCall) composite(s, d Pixel) Pixel {
+	if dc.compFn == nil {
+		return Pixel{}
+	}
+	if dc.blendFn != nil {
+		// applying the blending mode
+		if dc.fillFn != nil {
+			s = mixFill(dc.fillFn, s, d, dc.fill)
+		} else if dc.bl.Space == OKLabSpace {
+			s = mixOKLab(dc.bl, dc.blendFn, s, d, dc.linear)
+		} else {
+			s = mix(dc.bl, dc.blendFn, s, d)
 		}
 	}
+	// applying the alpha composition formula
+	return dc.compFn(s.scale(dc.opacity), d)
+}
+
+// clip clips r against the bounds of the bitmap, the source, the destination and the
+// optional mask image, adjusting the source, destination and mask points accordingly.
+// It's the equivalent of the unexported clip function from the image/draw package.
+func clip(
+	bitmap image.Image,
+	r *image.Rectangle,
+	src image.Image,
+	sp *image.Point,
+	dst image.Image,
+	dp *image.Point,
+	mask image.Image,
+	mp *image.Point,
+) {
+	orig := r.Min
+	*r = r.Intersect(bitmap.Bounds())
+	*r = r.Intersect(src.Bounds().Add(orig.Sub(*sp)))
+	*r = r.Intersect(dst.Bounds().Add(orig.Sub(*dp)))
+	if mask != nil {
+		*r = r.Intersect(mask.Bounds().Add(orig.Sub(*mp)))
+	}
+
+	dx := r.Min.X - orig.X
+	dy := r.Min.Y - orig.Y
+	if dx == 0 && dy == 0 {
+		return
+	}
+	sp.X += dx
+	sp.Y += dy
+	dp.X += dx
+	dp.Y += dy
+	if mask != nil {
+		mp.X += dx
+		mp.Y += dy
+	}
+}
+
+// shift compares the point p where the image img is read for r.Min with r.Min, when img is the output
+// image drawn in place. It returns a negative value if the pixels are read before r.Min in the top
+// to bottom, left to right order, a positive value if they are read after it, and zero otherwise.
+func shift(img image.Image, out draw.Image, p, min image.Point) int {
+	switch {
+	case img != image.Image(out) || p == min:
+		return 0
+	case p.Y < min.Y || p.Y == min.Y && p.X < min.X:
+		return -1
+	}
+	return 1
+}
+
+// snapshot returns a copy of the pixels of img within r.
+func snapshot(img image.Image, r image.Rectangle) image.Image {
+	switch img := img.(type) {
+	case *image.NRGBA:
+		c := image.NewNRGBA(r)
+		copyRows(c.Pix, c.Stride, img.Pix[img.PixOffset(r.Min.X, r.Min.Y):], img.Stride, 4*r.Dx(), r.Dy())
+		return c
+	case *image.RGBA:
+		c := image.NewRGBA(r)
+		copyRows(c.Pix, c.Stride, img.Pix[img.PixOffset(r.Min.X, r.Min.Y):], img.Stride, 4*r.Dx(), r.Dy())
+		return c
+	case *image.NRGBA64:
+		c := image.NewNRGBA64(r)
+		copyRows(c.Pix, c.Stride, img.Pix[img.PixOffset(r.Min.X, r.Min.Y):], img.Stride, 8*r.Dx(), r.Dy())
+		return c
+	case *image.RGBA64:
+		c := image.NewRGBA64(r)
+		copyRows(c.Pix, c.Stride, img.Pix[img.PixOffset(r.Min.X, r.Min.Y):], img.Stride, 8*r.Dx(), r.Dy())
+		return c
+	case *FloatRGBA:
+		c := NewFloatRGBA(r)
+		copyRows(c.Pix, c.Stride, img.Pix[img.PixOffset(r.Min.X, r.Min.Y):], img.Stride, 4*r.Dx(), r.Dy())
+		return c
+	}
+	c := image.NewNRGBA64(r)
+	draw.Draw(c, r, img, r.Min, draw.Src)
+
+	return c
+}
+
+// copyRows copies n elements of each of the given number of rows from src into dst.
+func copyRows[T uint8 | float32](dst []T, dstStride int, src []T, srcStride, n, rows int) {
+	for y := 0; y < rows; y++ {
+		copy(dst[y*dstStride:y*dstStride+n], src[y*srcStride:y*srcStride+n])
+	}
+}
+
+// The Porter-Duff operators expressed on alpha-premultiplied pixels.
+// See: https://www.w3.org/TR/compositing-1/#porterduffcompositingoperators
+
+func opClear(src, dst Pixel) Pixel {
+	return Pixel{}
+}
+
+func opCopy(src, dst Pixel) Pixel {
+	return src
+}
+
+func opDst(src, dst Pixel) Pixel {
+	return dst
+}
+
+func opSrcOver(src, dst Pixel) Pixel {
+	return src.add(dst.scale(1 - src.A))
+}
+
+func opDstOver(src, dst Pixel) Pixel {
+	return src.scale(1 - dst.A).add(dst)
+}
+
+func opSrcIn(src, dst Pixel) Pixel {
+	return src.scale(dst.A)
+}
+
+func opDstIn(src, dst Pixel) Pixel {
+	return dst.scale(src.A)
+}
+
+func opSrcOut(src, dst Pixel) Pixel {
+	return src.scale(1 - dst.A)
+}
+
+func opDstOut(src, dst Pixel) Pixel {
+	return dst.scale(1 - src.A)
+}
+
+func opSrcAtop(src, dst Pixel) Pixel {
+	return src.scale(dst.A).add(dst.scale(1 - src.A))
+}
+
+func opDstAtop(src, dst Pixel) Pixel {
+	return src.scale(1 - dst.A).add(dst.scale(src.A))
+}
+
+func opXor(src, dst Pixel) Pixel {
+	return src.scale(1 - dst.A).add(dst.scale(1 - src.A))
+}
+
+// opPlus adds the source and the destination, clamping the sum to the maximum value.
+// It's the lighter operator of Canvas 2D and the plus operator of Skia and Android.
+func opPlus(src, dst Pixel) Pixel {
+	return Pixel{
+		R: Min(1, src.R+dst.R),
+		G: Min(1, src.G+dst.G),
+		B: Min(1, src.B+dst.B),
+		A: Min(1, src.A+dst.A),
+	}
+}
+
+// opPlusDarker adds the inverted source and destination colors, then it inverts the sum,
+// clamping it to the minimum value. The opaque colors result in max(0, cs + cb - 1).
+func opPlusDarker(src, dst Pixel) Pixel {
+	a := Min(1, src.A+dst.A)
+	darker := func(s, d float64) float64 {
+		return Max(0, a-(src.A-s)-(dst.A-d))
+	}
+	return Pixel{
+		R: darker(src.R, dst.R),
+		G: darker(src.G, dst.G),
+		B: darker(src.B, dst.B),
+		A: a,
+	}
+}
+
+// opSaturate adds the source to the destination only as much as the destination is transparent,
+// so the result is never more opaque than the sum of the alphas. It's the saturate operator of Cairo.
+func opSaturate(src, dst Pixel) Pixel {
+	if src.A == 0 {
+		return dst
+	}
+	return src.scale(Min(1, (1-dst.A)/src.A)).add(dst)
+}
+
+// opModulate multiplies the source and the destination channels, including the alpha.
+// It's the modulate operator of Skia and the multiply operator of Android.
+func opModulate(src, dst Pixel) Pixel {
+	return Pixel{
+		R: src.R * dst.R,
+		G: src.G * dst.G,
+		B: src.B * dst.B,
+		A: src.A * dst.A,
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"image"
 	"image/color"
 	"image/draw"
+	"runtime"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -24,6 +25,48 @@ func TestComp_Basic(t *testing.T) {
 	assert.Equal(Dst, op.Get())
 }
 
+func TestComp_Register(t *testing.T) {
+	assert := assert.New(t)
+
+	const screen CompositeOp = "screen"
+
+	op := InitOp()
+	assert.Error(op.Set(screen))
+	assert.Error(op.Register("", opCopy))
+	assert.Error(op.Register(screen, nil))
+
+	err := op.Register(screen, func(src, dst Pixel) Pixel {
+		return src.add(dst).add(Pixel{
+			R: -src.R * dst.R,
+			G: -src.G * dst.G,
+			B: -src.B * dst.B,
+			A: -src.A * dst.A,
+		})
+	})
+	assert.NoError(err)
+	assert.Contains(op.Ops, screen)
+	assert.NoError(op.Set(screen))
+	assert.Equal(screen, op.Get())
+
+	rect := image.Rect(0, 0, 1, 1)
+	bmp := NewBitmap(rect)
+	source := image.NewNRGBA(rect)
+	backdrop := image.NewNRGBA(rect)
+	source.SetNRGBA(0, 0, color.NRGBA{R: 100, G: 0, B: 200, A: 255})
+	backdrop.SetNRGBA(0, 0, color.NRGBA{R: 100, G: 50, B: 100, A: 255})
+
+	op.Draw(bmp, source, backdrop, nil)
+	assert.EqualValues([]uint8{161, 50, 222, 255}, bmp.Img.Pix)
+
+	// Registering an existing name replaces the implementation without duplicating it.
+	n := len(op.Ops)
+	assert.NoError(op.Register(SrcOver, opDst))
+	assert.Len(op.Ops, n)
+	op.Set(SrcOver)
+	op.Draw(bmp, source, backdrop, nil)
+	assert.EqualValues([]uint8{100, 50, 100, 255}, bmp.Img.Pix)
+}
+
 func TestComp_Draw(t *testing.T) {
 	assert := assert.New(t)
 	imop := InitOp()
@@ -210,3 +253,768 @@ func TestComp_Draw(t *testing.T) {
 	assert.EqualValues(bottomLeft, cyan)
 	assert.EqualValues(center, magenta)
 }
+
+func TestComp_DrawBlendOperator(t *testing.T) {
+	assert := assert.New(t)
+	imop := InitOp()
+	blop := NewBlend()
+	blop.Set(Multiply)
+
+	transparent := color.NRGBA{R: 0, G: 0, B: 0, A: 0}
+	cyan := color.NRGBA{R: 33, G: 150, B: 243, A: 255}
+	magenta := color.NRGBA{R: 233, G: 30, B: 99, A: 255}
+	multiplied := color.NRGBA{R: 30, G: 18, B: 94, A: 255}
+
+	rect := image.Rect(0, 0, 10, 10)
+	bmp := NewBitmap(rect)
+	source := image.NewNRGBA(rect)
+	backdrop := image.NewNRGBA(rect)
+	draw.Draw(source, image.Rect(0, 4, 6, 10), &image.Uniform{cyan}, image.Point{}, draw.Src)
+	draw.Draw(backdrop, image.Rect(4, 0, 10, 6), &image.Uniform{magenta}, image.Point{}, draw.Src)
+
+	// The blend mode mixes the colors of the overlapping area,
+	// while the composition operation decides which areas are kept.
+	for _, tc := range []struct {
+		op                            CompositeOp
+		topRight, bottomLeft, overlap color.NRGBA
+	}{
+		{SrcOver, magenta, cyan, multiplied},
+		{SrcIn, transparent, transparent, multiplied},
+		{SrcAtop, magenta, transparent, multiplied},
+		{SrcOut, transparent, cyan, transparent},
+		{DstOver, magenta, cyan, magenta},
+		{DstOut, magenta, transparent, transparent},
+		{Xor, magenta, cyan, transparent},
+		{Clear, transparent, transparent, transparent},
+	} {
+		imop.Set(tc.op)
+		imop.Draw(bmp, source, backdrop, blop)
+
+		assert.EqualValues(tc.topRight, bmp.Img.At(9, 0), "operator %s", tc.op)
+		assert.EqualValues(tc.bottomLeft, bmp.Img.At(0, 9), "operator %s", tc.op)
+		assert.EqualValues(tc.overlap, bmp.Img.At(5, 5), "operator %s", tc.op)
+	}
+
+	// With semi-transparent pixels the mixed source color is Cs = (1 - αb) x Cs + αb x Cs x Cb,
+	// and the source-in operator keeps it with the alpha αs x αb.
+	src := image.NewUniform(color.NRGBA{R: 200, G: 100, B: 50, A: 128})
+	dst := image.NewUniform(color.NRGBA{R: 100, G: 200, B: 250, A: 192})
+	imop.Set(SrcIn)
+	imop.DrawAt(bmp, rect, src, image.Point{}, dst, image.Point{}, blop)
+
+	as, ab := 128.0/255, 192.0/255
+	mixed := func(cs, cb float64) float64 {
+		cs, cb = cs/255, cb/255
+		return ((1-ab)*cs + ab*cs*cb) * 255
+	}
+	c := bmp.Img.NRGBAAt(1, 1)
+	assert.InDelta(mixed(200, 100), float64(c.R), 1)
+	assert.InDelta(mixed(100, 200), float64(c.G), 1)
+	assert.InDelta(mixed(50, 250), float64(c.B), 1)
+	assert.InDelta(as*ab*255, float64(c.A), 1)
+}
+
+func TestComp_CanvasOperators(t *testing.T) {
+	assert := assert.New(t)
+	imop := InitOp()
+
+	rect := image.Rect(0, 0, 1, 1)
+	bmp := NewBitmap(rect)
+	composite := func(op CompositeOp, src, dst color.NRGBA) []uint8 {
+		assert.NoError(imop.Set(op))
+		imop.DrawAt(bmp, rect, image.NewUniform(src), image.Point{}, image.NewUniform(dst), image.Point{}, nil)
+		return bmp.Img.Pix
+	}
+
+	opaqueSrc := color.NRGBA{R: 200, G: 100, B: 50, A: 255}
+	opaqueDst := color.NRGBA{R: 100, G: 200, B: 250, A: 255}
+	semiSrc := color.NRGBA{R: 200, G: 100, B: 50, A: 128}
+	semiDst := color.NRGBA{R: 100, G: 200, B: 250, A: 64}
+	transparent := color.NRGBA{}
+
+	assert.Equal(Plus, Lighter)
+	for _, tc := range []struct {
+		op       CompositeOp
+		src, dst color.NRGBA
+		want     []uint8
+	}{
+		// The sums above the maximum value are clamped.
+		{Plus, opaqueSrc, opaqueDst, []uint8{255, 255, 255, 255}},
+		{Plus, semiSrc, semiDst, []uint8{166, 133, 116, 192}},
+		{Plus, transparent, semiDst, []uint8{100, 200, 250, 64}},
+		// The opaque colors result in max(0, cs + cb - 1).
+		{PlusDarker, opaqueSrc, opaqueDst, []uint8{45, 45, 45, 255}},
+		{PlusDarker, opaqueSrc, color.NRGBA{R: 20, G: 255, B: 0, A: 255}, []uint8{0, 100, 0, 255}},
+		{PlusDarker, transparent, semiDst, []uint8{100, 200, 250, 64}},
+		{PlusDarker, semiSrc, transparent, []uint8{200, 100, 50, 128}},
+		// The source is added only as much as the destination is transparent.
+		{Saturate, opaqueSrc, opaqueDst, []uint8{100, 200, 250, 255}},
+		{Saturate, opaqueSrc, semiDst, []uint8{174, 125, 100, 255}},
+		{Saturate, semiSrc, transparent, []uint8{200, 100, 50, 128}},
+		{Saturate, transparent, semiDst, []uint8{100, 200, 250, 64}},
+		// All the channels are multiplied, including the alpha.
+		{Modulate, opaqueSrc, opaqueDst, []uint8{78, 78, 49, 255}},
+		{Modulate, semiSrc, opaqueDst, []uint8{78, 78, 49, 128}},
+		{Modulate, semiSrc, transparent, []uint8{0, 0, 0, 0}},
+	} {
+		got := composite(tc.op, tc.src, tc.dst)
+		assert.True(compareBytes(tc.want, got, 1), "%s: %v over %v, expected %v, got %v", tc.op, tc.src, tc.dst, tc.want, got)
+	}
+}
+
+func TestComp_DrawAt(t *testing.T) {
+	assert := assert.New(t)
+	imop := InitOp()
+
+	cyan := color.NRGBA{R: 33, G: 150, B: 243, A: 255}
+	magenta := color.NRGBA{R: 233, G: 30, B: 99, A: 255}
+	transparent := color.NRGBA{}
+
+	// Place a 4x4 sprite having a transparent border at (10, 5) on a 20x20 backdrop.
+	sprite := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	draw.Draw(sprite, image.Rect(1, 1, 3, 3), &image.Uniform{cyan}, image.Point{}, draw.Src)
+	backdrop := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	draw.Draw(backdrop, backdrop.Bounds(), &image.Uniform{magenta}, image.Point{}, draw.Src)
+
+	bmp := NewBitmap(backdrop.Bounds())
+	r := image.Rect(10, 5, 14, 9)
+	imop.DrawAt(bmp, r, sprite, image.Point{}, backdrop, r.Min, nil)
+
+	assert.EqualValues(transparent, bmp.Img.At(0, 0))
+	assert.EqualValues(transparent, bmp.Img.At(9, 5))
+	assert.EqualValues(magenta, bmp.Img.At(10, 5))
+	assert.EqualValues(cyan, bmp.Img.At(11, 6))
+	assert.EqualValues(cyan, bmp.Img.At(12, 7))
+	assert.EqualValues(magenta, bmp.Img.At(13, 8))
+	assert.EqualValues(transparent, bmp.Img.At(14, 9))
+
+	// Source and destination images with a non-zero min point.
+	src := image.NewNRGBA(image.Rect(-5, -5, 5, 5))
+	src.SetNRGBA(-5, -5, cyan)
+	dst := image.NewNRGBA(image.Rect(100, 100, 110, 110))
+	dst.SetNRGBA(101, 100, magenta)
+
+	bmp = NewBitmap(image.Rect(0, 0, 10, 10))
+	imop.Draw(bmp, src, dst, nil)
+	assert.EqualValues(cyan, bmp.Img.At(0, 0))
+	assert.EqualValues(magenta, bmp.Img.At(1, 0))
+	assert.EqualValues(transparent, bmp.Img.At(1, 1))
+
+	// The destination rectangle is clipped to the bounds of every image,
+	// while the source and destination points are shifted accordingly.
+	bmp = NewBitmap(image.Rect(0, 0, 10, 10))
+	imop.Set(Copy)
+	imop.DrawAt(bmp, image.Rect(-2, -2, 3, 3), src, image.Pt(-7, -7), dst, image.Pt(98, 98), nil)
+	assert.EqualValues(cyan, bmp.Img.At(0, 0))
+	for x := 0; x < 10; x++ {
+		for y := 0; y < 10; y++ {
+			if x == 0 && y == 0 {
+				continue
+			}
+			assert.EqualValues(transparent, bmp.Img.At(x, y))
+		}
+	}
+
+	// Empty intersections leave the bitmap untouched.
+	bmp = NewBitmap(image.Rect(0, 0, 10, 10))
+	imop.DrawAt(bmp, image.Rect(20, 20, 30, 30), src, image.Point{}, dst, image.Point{}, nil)
+	assert.Equal(make([]uint8, len(bmp.Img.Pix)), bmp.Img.Pix)
+}
+
+func TestComp_DrawAtMatchesDrawOver(t *testing.T) {
+	assert := assert.New(t)
+	imop := InitOp()
+
+	cyan := color.NRGBA{R: 33, G: 150, B: 243, A: 255}
+	magenta := color.NRGBA{R: 233, G: 30, B: 99, A: 255}
+
+	src := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	draw.Draw(src, image.Rect(2, 2, 6, 6), &image.Uniform{cyan}, image.Point{}, draw.Src)
+
+	rects := []struct {
+		r  image.Rectangle
+		sp image.Point
+	}{
+		{image.Rect(0, 0, 8, 8), image.Point{}},
+		{image.Rect(12, 3, 20, 11), image.Point{}},
+		{image.Rect(-3, -3, 5, 5), image.Pt(1, 2)},
+		{image.Rect(14, 14, 30, 30), image.Pt(2, 2)},
+	}
+	for _, tc := range rects {
+		want := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+		draw.Draw(want, want.Bounds(), &image.Uniform{magenta}, image.Point{}, draw.Src)
+		draw.Draw(want, tc.r, src, tc.sp, draw.Over)
+
+		// Compose in place, by using the bitmap image as the destination.
+		bmp := NewBitmap(image.Rect(0, 0, 16, 16))
+		draw.Draw(bmp.Img, bmp.Img.Bounds(), &image.Uniform{magenta}, image.Point{}, draw.Src)
+		imop.DrawAt(bmp, tc.r, src, tc.sp, bmp.Img, tc.r.Min, nil)
+
+		assert.Equal(want.Pix, bmp.Img.Pix, "rect: %v, sp: %v", tc.r, tc.sp)
+	}
+}
+
+func TestComp_DrawOverlapping(t *testing.T) {
+	assert := assert.New(t)
+
+	bounds := image.Rect(0, 0, 150, 8)
+	opaque := makeTestImage(bounds, 3)
+	for i := 3; i < len(opaque.Pix); i += 4 {
+		opaque.Pix[i] = 255
+	}
+	clone := func(img *image.NRGBA) *image.NRGBA {
+		c := image.NewNRGBA(img.Rect)
+		copy(c.Pix, img.Pix)
+		return c
+	}
+
+	imop := InitOp()
+	imop.Set(Copy)
+
+	// Copying a bitmap onto itself with a shifted source point moves the image like draw.Draw,
+	// whatever the direction of the shift, including across the chunks of the rows.
+	for _, tc := range []struct {
+		r  image.Rectangle
+		sp image.Point
+	}{
+		{image.Rect(0, 1, 4, 4), image.Pt(0, 0)},
+		{image.Rect(0, 0, 4, 3), image.Pt(0, 1)},
+		{image.Rect(1, 0, 150, 8), image.Pt(0, 0)},
+		{image.Rect(0, 0, 149, 8), image.Pt(1, 0)},
+		{image.Rect(70, 2, 150, 8), image.Pt(0, 0)},
+		{image.Rect(0, 0, 80, 6), image.Pt(70, 2)},
+		{image.Rect(3, 0, 150, 6), image.Pt(0, 2)},
+	} {
+		want := clone(opaque)
+		draw.Draw(want, tc.r, want, tc.sp, draw.Src)
+
+		bmp := NewBitmapFrom(clone(opaque))
+		imop.DrawAt(bmp, tc.r, bmp.Image(), tc.sp, bmp.Image(), tc.r.Min, nil)
+		assert.Equal(want.Pix, bmp.Image().(*image.NRGBA).Pix, "rect: %v, sp: %v", tc.r, tc.sp)
+	}
+
+	// The source and the backdrop read in place with opposite shifts give
+	// the same result as reading them from a copy of the bitmap.
+	imop.Set(SrcOver)
+	blop := NewBlend()
+	blop.Set(Multiply)
+	src := makeTestImage(bounds, 5)
+	r := image.Rect(0, 1, 140, 7)
+	sp, dp := image.Pt(0, 0), image.Pt(10, 2)
+
+	want := NewBitmapFrom(clone(src))
+	imop.DrawAt(want, r, clone(src), sp, clone(src), dp, blop)
+
+	bmp := NewBitmapFrom(clone(src))
+	imop.DrawAt(bmp, r, bmp.Image(), sp, bmp.Image(), dp, blop)
+	assert.Equal(want.Image().(*image.NRGBA).Pix, bmp.Image().(*image.NRGBA).Pix)
+}
+
+func TestComp_DrawMask(t *testing.T) {
+	assert := assert.New(t)
+
+	cyan := color.NRGBA{R: 33, G: 150, B: 243, A: 255}
+	magenta := color.NRGBA{R: 233, G: 30, B: 99, A: 128}
+
+	rect := image.Rect(0, 0, 4, 4)
+	source := image.NewNRGBA(rect)
+	backdrop := image.NewNRGBA(rect)
+	draw.Draw(source, rect, &image.Uniform{cyan}, image.Point{}, draw.Src)
+	draw.Draw(backdrop, rect, &image.Uniform{magenta}, image.Point{}, draw.Src)
+
+	// The source alpha pre-multiplied by hand with the mask alpha.
+	masked := image.NewNRGBA(rect)
+	draw.Draw(masked, rect, &image.Uniform{color.NRGBA{R: cyan.R, G: cyan.G, B: cyan.B, A: 0x80}}, image.Point{}, draw.Src)
+	mask := image.NewUniform(color.Alpha{A: 0x80})
+
+	imop := InitOp()
+	for _, op := range imop.Ops {
+		imop.Set(op)
+
+		want := NewBitmap(rect)
+		imop.DrawAt(want, rect, masked, image.Point{}, backdrop, image.Point{}, nil)
+		got := NewBitmap(rect)
+		imop.DrawMask(got, rect, source, image.Point{}, backdrop, image.Point{}, mask, image.Point{}, nil)
+		assert.True(compareBytes(want.Img.Pix, got.Img.Pix, 1), "op %s: got %v, want %v", op, got.Img.Pix[:4], want.Img.Pix[:4])
+
+		// A nil mask is the same as drawing without a mask.
+		imop.DrawAt(want, rect, source, image.Point{}, backdrop, image.Point{}, nil)
+		imop.DrawMask(got, rect, source, image.Point{}, backdrop, image.Point{}, nil, image.Point{}, nil)
+		assert.Equal(want.Img.Pix, got.Img.Pix, "op %s", op)
+	}
+
+	blop := NewBlend()
+	imop.Set(SrcOver)
+	for _, mode := range blop.Modes {
+		blop.Set(mode)
+
+		want := NewBitmap(rect)
+		imop.DrawAt(want, rect, masked, image.Point{}, backdrop, image.Point{}, blop)
+		got := NewBitmap(rect)
+		imop.DrawMask(got, rect, source, image.Point{}, backdrop, image.Point{}, mask, image.Point{}, blop)
+		assert.True(compareBytes(want.Img.Pix, got.Img.Pix, 1), "mode %s: got %v, want %v", mode, got.Img.Pix[:4], want.Img.Pix[:4])
+	}
+}
+
+func TestComp_DrawMaskMatchesDrawMaskOver(t *testing.T) {
+	assert := assert.New(t)
+	imop := InitOp()
+
+	cyan := color.NRGBA{R: 33, G: 150, B: 243, A: 255}
+	magenta := color.NRGBA{R: 233, G: 30, B: 99, A: 255}
+
+	// A feathered horizontal selection mask, having a different size than the other images.
+	mask := image.NewAlpha(image.Rect(0, 0, 8, 4))
+	for x := 0; x < 8; x++ {
+		for y := 0; y < 4; y++ {
+			mask.SetAlpha(x, y, color.Alpha{A: uint8(x * 255 / 7)})
+		}
+	}
+	src := image.NewUniform(cyan)
+
+	want := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	draw.Draw(want, want.Bounds(), &image.Uniform{magenta}, image.Point{}, draw.Src)
+	bmp := NewBitmap(want.Bounds())
+	copy(bmp.Img.Pix, want.Pix)
+
+	r := image.Rect(2, 6, 14, 14)
+	draw.DrawMask(want, r, src, image.Point{}, mask, image.Pt(1, 1), draw.Over)
+	imop.DrawMask(bmp, r, src, image.Point{}, bmp.Img, r.Min, mask, image.Pt(1, 1), nil)
+
+	assert.True(compareBytes(want.Pix, bmp.Img.Pix, 1), "got %v, want %v", bmp.Img.Pix, want.Pix)
+	// Outside of the mask bounds the bitmap is left untouched.
+	assert.EqualValues(magenta, bmp.Img.At(2, 13))
+	assert.EqualValues(magenta, bmp.Img.At(9, 6))
+}
+
+func TestComp_Opacity(t *testing.T) {
+	assert := assert.New(t)
+
+	imop := InitOp()
+	assert.Equal(1.0, imop.Opacity)
+	assert.Error(imop.SetOpacity(-0.1))
+	assert.Error(imop.SetOpacity(1.1))
+	assert.Equal(1.0, imop.Opacity)
+
+	cyan := color.NRGBA{R: 33, G: 150, B: 243, A: 255}
+	magenta := color.NRGBA{R: 233, G: 30, B: 99, A: 255}
+
+	rect := image.Rect(0, 0, 10, 10)
+	source := image.NewNRGBA(rect)
+	backdrop := image.NewNRGBA(rect)
+	draw.Draw(source, image.Rect(0, 4, 6, 10), &image.Uniform{cyan}, image.Point{}, draw.Src)
+	draw.Draw(source, image.Rect(6, 4, 10, 10), &image.Uniform{color.NRGBA{R: 33, G: 150, B: 243, A: 100}}, image.Point{}, draw.Src)
+	draw.Draw(backdrop, image.Rect(4, 0, 10, 6), &image.Uniform{magenta}, image.Point{}, draw.Src)
+	transparent := image.NewNRGBA(rect)
+
+	for _, op := range imop.Ops {
+		imop.Set(op)
+
+		// Opacity 1 matches the output obtained without setting the opacity.
+		ref := InitOp()
+		ref.Set(op)
+		want := NewBitmap(rect)
+		ref.Draw(want, source, backdrop, nil)
+		got := NewBitmap(rect)
+		imop.SetOpacity(1)
+		imop.Draw(got, source, backdrop, nil)
+		assert.Equal(want.Img.Pix, got.Img.Pix, "op %s", op)
+
+		// Opacity 0 is the same as compositing a fully transparent source.
+		imop.Draw(want, transparent, backdrop, nil)
+		imop.SetOpacity(0)
+		imop.Draw(got, source, backdrop, nil)
+		assert.Equal(want.Img.Pix, got.Img.Pix, "op %s", op)
+	}
+
+	// With the source-over operator, opacity 0 leaves the backdrop untouched.
+	imop.Set(SrcOver)
+	bmp := NewBitmap(rect)
+	imop.Draw(bmp, source, backdrop, nil)
+	assert.Equal(backdrop.Pix, bmp.Img.Pix)
+
+	// Half opacity is the same as drawing through a half transparent mask.
+	imop.SetOpacity(0.5)
+	imop.Draw(bmp, source, backdrop, nil)
+	want := image.NewNRGBA(rect)
+	copy(want.Pix, backdrop.Pix)
+	draw.DrawMask(want, rect, source, image.Point{}, image.NewUniform(color.Alpha{A: 0x80}), image.Point{}, draw.Over)
+	assert.True(compareBytes(want.Pix, bmp.Img.Pix, 1), "got %v, want %v", bmp.Img.Pix, want.Pix)
+}
+
+func TestComp_OpacityBlend(t *testing.T) {
+	assert := assert.New(t)
+
+	imop := InitOp()
+	blop := NewBlend()
+
+	rect := image.Rect(0, 0, 2, 1)
+	source := image.NewNRGBA(rect)
+	backdrop := image.NewNRGBA(rect)
+	source.SetNRGBA(0, 0, color.NRGBA{R: 214, G: 20, B: 65, A: 255})
+	source.SetNRGBA(1, 0, color.NRGBA{R: 33, G: 150, B: 243, A: 255})
+	backdrop.SetNRGBA(0, 0, color.NRGBA{R: 250, G: 121, B: 17, A: 255})
+	backdrop.SetNRGBA(1, 0, color.NRGBA{R: 233, G: 30, B: 99, A: 255})
+
+	for _, mode := range blop.Modes {
+		// The opacity of the dissolve mode drops pixels instead of interpolating them, see TestBlend_Dissolve.
+		if mode == Dissolve {
+			continue
+		}
+		blop.Set(mode)
+
+		full := NewBitmap(rect)
+		imop.SetOpacity(1)
+		imop.Draw(full, source, backdrop, blop)
+
+		// Opacity 0 is an identity.
+		bmp := NewBitmap(rect)
+		imop.SetOpacity(0)
+		imop.Draw(bmp, source, backdrop, blop)
+		assert.Equal(backdrop.Pix, bmp.Img.Pix, "mode %s", mode)
+
+		// The result of the blend mode is interpolated with the backdrop.
+		imop.SetOpacity(0.5)
+		imop.Draw(bmp, source, backdrop, blop)
+		for i := range bmp.Img.Pix {
+			want := (float64(backdrop.Pix[i]) + float64(full.Img.Pix[i])) / 2
+			assert.InDelta(want, float64(bmp.Img.Pix[i]), 1, "mode %s, channel %d", mode, i)
+		}
+	}
+}
+
+func TestComp_Workers(t *testing.T) {
+	assert := assert.New(t)
+
+	imop := InitOp()
+	assert.Equal(0, imop.Workers)
+	assert.Error(imop.SetWorkers(-1))
+	assert.NoError(imop.SetWorkers(4))
+	assert.Equal(4, imop.Workers)
+
+	source := makeTestImage(image.Rect(0, 0, 37, 29), 1)
+	backdrop := makeTestImage(image.Rect(0, 0, 41, 33), 2)
+	r := image.Rect(3, 2, 40, 31)
+
+	blop := NewBlend()
+	modes := append([]BlendMode{""}, blop.Modes...)
+
+	for _, op := range imop.Ops {
+		imop.Set(op)
+		for _, mode := range modes {
+			var bl *Blend
+			if mode != "" {
+				blop.Set(mode)
+				bl = blop
+			}
+			imop.SetWorkers(1)
+			want := NewBitmap(backdrop.Bounds())
+			imop.DrawAt(want, r, source, image.Point{}, backdrop, r.Min, bl)
+
+			for _, n := range []int{0, 2, 3, 7, 64} {
+				imop.SetWorkers(n)
+				got := NewBitmap(backdrop.Bounds())
+				imop.DrawAt(got, r, source, image.Point{}, backdrop, r.Min, bl)
+				assert.Equal(want.Img.Pix, got.Img.Pix, "op %s, mode %s, workers %d", op, mode, n)
+			}
+		}
+	}
+}
+
+// makeTestImage returns an image filled with a deterministic
+// pattern of colors having different levels of transparency.
+func makeTestImage(rect image.Rectangle, seed int) *image.NRGBA {
+	img := image.NewNRGBA(rect)
+	for i := range img.Pix {
+		img.Pix[i] = uint8((i*i*seed + i*31 + seed*17) % 256)
+	}
+	return img
+}
+
+func BenchmarkComp_Draw(b *testing.B) {
+	rect := image.Rect(0, 0, 1920, 1080)
+	source := makeTestImage(rect, 1)
+	backdrop := makeTestImage(rect, 2)
+	bmp := NewBitmap(rect)
+
+	blop := NewBlend()
+	blop.Set(Multiply)
+
+	for _, bench := range []struct {
+		name    string
+		workers int
+		bl      *Blend
+	}{
+		{"Serial", 1, nil},
+		{"Parallel", 0, nil},
+		{"SerialBlend", 1, blop},
+		{"ParallelBlend", 0, blop},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			imop := InitOp()
+			imop.SetWorkers(bench.workers)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				imop.Draw(bmp, source, backdrop, bench.bl)
+			}
+		})
+	}
+}
+
+func BenchmarkComp_DrawGeneric(b *testing.B) {
+	rect := image.Rect(0, 0, 1920, 1080)
+	source := genericImage{makeTestImage(rect, 1)}
+	backdrop := genericImage{makeTestImage(rect, 2)}
+	bmp := NewBitmap(rect)
+
+	imop := InitOp()
+	imop.SetWorkers(1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		imop.DrawAt(bmp, rect, source, image.Point{}, backdrop, image.Point{}, nil)
+	}
+}
+
+// genericImage hides the concrete type of the embedded image,
+// forcing the drawing methods to use the generic pixel accessors.
+type genericImage struct {
+	image.Image
+}
+
+func TestComp_DrawFastPath(t *testing.T) {
+	assert := assert.New(t)
+
+	source := makeTestImage(image.Rect(0, 0, 150, 20), 1)
+	backdrop := makeTestImage(image.Rect(0, 0, 150, 20), 2)
+	mask := image.NewAlpha(image.Rect(0, 0, 150, 20))
+	copy(mask.Pix, makeTestImage(image.Rect(0, 0, 150, 5), 3).Pix)
+	r := image.Rect(1, 2, 149, 19)
+
+	imop := InitOp()
+	blop := NewBlend()
+	modes := append([]BlendMode{""}, blop.Modes...)
+
+	for _, op := range imop.Ops {
+		imop.Set(op)
+		for _, mode := range modes {
+			var bl *Blend
+			if mode != "" {
+				blop.Set(mode)
+				bl = blop
+			}
+			want := NewBitmap(backdrop.Bounds())
+			imop.DrawMask(want, r, genericImage{source}, r.Min, genericImage{backdrop}, r.Min, genericImage{mask}, r.Min, bl)
+			got := NewBitmap(backdrop.Bounds())
+			imop.DrawMask(got, r, source, r.Min, backdrop, r.Min, mask, r.Min, bl)
+			assert.Equal(want.Img.Pix, got.Img.Pix, "op %s, mode %s", op, mode)
+		}
+	}
+}
+
+func TestComp_DrawAllocs(t *testing.T) {
+	rect := image.Rect(0, 0, 256, 256)
+	source := makeTestImage(rect, 1)
+	backdrop := makeTestImage(rect, 2)
+	mask := image.NewAlpha(rect)
+	bmp := NewBitmap(rect)
+
+	rgbaSource := image.NewRGBA(rect)
+	rgbaBackdrop := image.NewRGBA(rect)
+	rgbaBmp := NewBitmapFrom(image.NewRGBA(rect))
+	nrgba64Source := image.NewNRGBA64(rect)
+	nrgba64Backdrop := image.NewNRGBA64(rect)
+	nrgba64Bmp := NewBitmapFrom(image.NewNRGBA64(rect))
+
+	imop := InitOp()
+	imop.SetWorkers(1)
+	blop := NewBlend()
+	blop.Set(Multiply)
+	linop := InitOp()
+	linop.SetWorkers(1)
+	linop.SetLinear(true)
+
+	for _, tc := range []struct {
+		name string
+		fn   func()
+	}{
+		{"Draw", func() { imop.Draw(bmp, source, backdrop, nil) }},
+		{"DrawBlend", func() { imop.Draw(bmp, source, backdrop, blop) }},
+		{"DrawMask", func() {
+			imop.DrawMask(bmp, rect, source, image.Point{}, backdrop, image.Point{}, mask, image.Point{}, nil)
+		}},
+		{"DrawRGBA", func() { imop.DrawRGBA(rgbaBmp, rgbaSource, rgbaBackdrop, nil) }},
+		{"DrawNRGBA64", func() {
+			imop.DrawAt(nrgba64Bmp, rect, nrgba64Source, image.Point{}, nrgba64Backdrop, image.Point{}, nil)
+		}},
+		{"DrawLinear", func() { linop.Draw(bmp, source, backdrop, blop) }},
+	} {
+		if allocs := testing.AllocsPerRun(10, tc.fn); allocs != 0 {
+			t.Errorf("%s: expected zero allocations, got %v", tc.name, allocs)
+		}
+	}
+
+	// The zero allocations are guaranteed only for a single worker. With more workers, the allocations
+	// are limited to the goroutines of the bands and to the shared parameters, whatever the image size.
+	for _, workers := range []int{0, 4} {
+		imop.SetWorkers(workers)
+		n := workers
+		if n == 0 {
+			n = runtime.GOMAXPROCS(0)
+		}
+		limit := float64(2*n + 2)
+		if n == 1 {
+			limit = 0
+		}
+		if allocs := testing.AllocsPerRun(10, func() { imop.Draw(bmp, source, backdrop, blop) }); allocs > limit {
+			t.Errorf("%d workers: expected at most %v allocations, got %v", workers, limit, allocs)
+		}
+	}
+}
+
+func TestComp_DrawRGBA(t *testing.T) {
+	assert := assert.New(t)
+
+	rect := image.Rect(0, 0, 64, 16)
+	srcNRGBA := makeTestImage(rect, 1)
+	dstNRGBA := makeTestImage(rect, 2)
+	source := image.NewRGBA(rect)
+	backdrop := image.NewRGBA(rect)
+	draw.Draw(source, rect, srcNRGBA, image.Point{}, draw.Src)
+	draw.Draw(backdrop, rect, dstNRGBA, image.Point{}, draw.Src)
+
+	bmp := NewBitmapFrom(image.NewRGBA(rect))
+	assert.Nil(bmp.Img)
+	assert.IsType(&image.RGBA{}, bmp.Image())
+	nrgba := image.NewNRGBA(rect)
+	assert.Same(nrgba, NewBitmapFrom(nrgba).Img)
+
+	imop := InitOp()
+	blop := NewBlend()
+	modes := append([]BlendMode{""}, blop.Modes...)
+
+	for _, op := range imop.Ops {
+		imop.Set(op)
+		for _, mode := range modes {
+			var bl *Blend
+			if mode != "" {
+				blop.Set(mode)
+				bl = blop
+			}
+			// The premultiplied pipeline gives the same results as the non-premultiplied one.
+			imop.DrawRGBA(bmp, source, backdrop, bl)
+			ref := NewBitmap(rect)
+			imop.DrawAt(ref, rect, source, image.Point{}, backdrop, image.Point{}, bl)
+			want := image.NewRGBA(rect)
+			draw.Draw(want, rect, ref.Img, image.Point{}, draw.Src)
+			got := bmp.Image().(*image.RGBA)
+			assert.True(compareBytes(want.Pix, got.Pix, 1), "op %s, mode %s", op, mode)
+
+			// Drawing into any other draw.Image uses the generic accessors.
+			generic := NewBitmapFrom(genericDrawImage{image.NewRGBA(rect)})
+			imop.DrawRGBA(generic, source, backdrop, bl)
+			genericPix := generic.Image().(genericDrawImage).Image.(*image.RGBA).Pix
+			assert.True(compareBytes(got.Pix, genericPix, 1), "op %s, mode %s", op, mode)
+		}
+	}
+}
+
+func TestComp_DrawRGBAPrecision(t *testing.T) {
+	assert := assert.New(t)
+
+	rect := image.Rect(0, 0, 4, 1)
+	source := image.NewRGBA(rect)
+	backdrop := image.NewRGBA(rect)
+	// Low alpha values, which cannot be represented exactly in the non-premultiplied form.
+	source.SetRGBA(0, 0, color.RGBA{R: 1, G: 0, B: 2, A: 2})
+	source.SetRGBA(1, 0, color.RGBA{R: 3, G: 1, B: 0, A: 5})
+	backdrop.SetRGBA(2, 0, color.RGBA{R: 2, G: 1, B: 1, A: 3})
+	backdrop.SetRGBA(3, 0, color.RGBA{R: 200, G: 100, B: 7, A: 201})
+
+	imop := InitOp()
+	bmp := NewBitmapFrom(image.NewRGBA(rect))
+	imop.DrawRGBA(bmp, source, backdrop, nil)
+	assert.Equal([]uint8{1, 0, 2, 2, 3, 1, 0, 5, 2, 1, 1, 3, 200, 100, 7, 201}, bmp.Image().(*image.RGBA).Pix)
+
+	imop.Set(Dst)
+	imop.DrawRGBA(bmp, source, backdrop, nil)
+	assert.Equal(backdrop.Pix, bmp.Image().(*image.RGBA).Pix)
+
+	// Compared to the draw.Draw source-over operator on premultiplied images.
+	src := image.NewRGBA(image.Rect(0, 0, 64, 16))
+	dst := image.NewRGBA(src.Bounds())
+	draw.Draw(src, src.Bounds(), makeTestImage(src.Bounds(), 1), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), makeTestImage(dst.Bounds(), 2), image.Point{}, draw.Src)
+
+	imop.Set(SrcOver)
+	bmp = NewBitmapFrom(image.NewRGBA(src.Bounds()))
+	imop.DrawRGBA(bmp, src, dst, nil)
+	draw.Draw(dst, dst.Bounds(), src, image.Point{}, draw.Over)
+	assert.True(compareBytes(dst.Pix, bmp.Image().(*image.RGBA).Pix, 1))
+}
+
+func TestComp_Draw16(t *testing.T) {
+	assert := assert.New(t)
+
+	// A 16-bit horizontal gray gradient, having far more levels than an 8-bit image can hold.
+	rect := image.Rect(0, 0, 4096, 1)
+	gradient := image.NewNRGBA64(rect)
+	for x := 0; x < rect.Dx(); x++ {
+		v := uint16(x * 0xffff / (rect.Dx() - 1))
+		gradient.SetNRGBA64(x, 0, color.NRGBA64{R: v, G: v, B: v, A: 0xffff})
+	}
+	backdrop := image.NewNRGBA64(rect)
+	draw.Draw(backdrop, rect, &image.Uniform{color.NRGBA64{R: 0x4ccc, G: 0x9999, B: 0xcccc, A: 0x8000}}, image.Point{}, draw.Src)
+
+	levels := func(img *image.NRGBA64) int {
+		values := make(map[uint16]struct{})
+		for x := 0; x < rect.Dx(); x++ {
+			values[img.NRGBA64At(x, 0).R] = struct{}{}
+		}
+		return len(values)
+	}
+	assert.Equal(rect.Dx(), levels(gradient))
+
+	// Source-over an opaque source keeps every level of the gradient.
+	imop := InitOp()
+	bmp := NewBitmapFrom(image.NewNRGBA64(rect))
+	imop.DrawAt(bmp, rect, gradient, image.Point{}, backdrop, image.Point{}, nil)
+	assert.Equal(gradient.Pix, bmp.Image().(*image.NRGBA64).Pix)
+
+	for _, op := range []CompositeOp{Copy, SrcOver, DstOver, SrcIn, SrcOut, SrcAtop, DstAtop, Xor} {
+		imop.Set(op)
+		bmp := NewBitmapFrom(image.NewNRGBA64(rect))
+		imop.DrawAt(bmp, rect, gradient, image.Point{}, backdrop, image.Point{}, nil)
+		assert.Greater(levels(bmp.Image().(*image.NRGBA64)), 1024, "op %s", op)
+
+		rgba64 := NewBitmapFrom(image.NewRGBA64(rect))
+		imop.DrawAt(rgba64, rect, gradient, image.Point{}, backdrop, image.Point{}, nil)
+		assert.Greater(levels(toNRGBA64(rgba64.Image())), 1024, "op %s", op)
+	}
+
+	imop.Set(SrcOver)
+	blop := NewBlend()
+	for _, mode := range blop.Modes {
+		blop.Set(mode)
+		bmp := NewBitmapFrom(image.NewNRGBA64(rect))
+		imop.DrawAt(bmp, rect, gradient, image.Point{}, backdrop, image.Point{}, blop)
+		assert.Greater(levels(bmp.Image().(*image.NRGBA64)), 1024, "mode %s", mode)
+	}
+
+	// The same gradient composited into an 8-bit bitmap is banded.
+	bmp8 := NewBitmap(rect)
+	imop.DrawAt(bmp8, rect, gradient, image.Point{}, backdrop, image.Point{}, nil)
+	values := make(map[uint8]struct{})
+	for x := 0; x < rect.Dx(); x++ {
+		values[bmp8.Img.Pix[x*4]] = struct{}{}
+	}
+	assert.LessOrEqual(len(values), 256)
+}
+
+// toNRGBA64 converts any image type to *image.NRGBA64.
+func toNRGBA64(img image.Image) *image.NRGBA64 {
+	dst := image.NewNRGBA64(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	return dst
+}
@@ -35,10 +35,12 @@ func main() {
 	imop := gomp.InitOp()
 	blop := gomp.NewBlend()
 
-	dc := gg.NewContext(1024, 1024)
+	// Four blend modes are drawn on every row.
+	height := (len(blop.Modes) + 3) / 4 * 256
+	dc := gg.NewContext(1024, height)
 	dc.Clear()
 	dc.SetRGB(1, 1, 1)
-	dc.DrawRectangle(0, 0, 1024, 1024)
+	dc.DrawRectangle(0, 0, 1024, float64(height))
 	dc.Fill()
 
 	font, err := truetype.Parse(goregular.TTF)
@@ -82,7 +84,7 @@ func main() {
 		bmp := gomp.NewBitmap(image.Rect(0, 0, size, size))
 		imop.Draw(bmp, srcImg, bgr, blop)
 
-		dx, _ := dc.MeasureString(op)
+		dx, _ := dc.MeasureString(string(op))
 		dc.DrawImage(bmp.Img, gridX, gridY)
 		dc.DrawRectangle(float64(gridX), float64(gridY), float64(gridX+size), float64(gridY+size))
 		dc.SetRGB(0.7, 0.7, 0.7)
@@ -90,7 +92,7 @@ func main() {
 
 		dc.SetRGB(1, 1, 1)
 		dc.Stroke()
-		opName := strings.ReplaceAll(op, "_", " ")
+		opName := strings.ReplaceAll(string(op), "_", " ")
 		dc.DrawString(opName, float64(gridX)+(float64(size)/2-dx/2), float64(gridY-5+size))
 
 		gridX += size
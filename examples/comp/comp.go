@@ -14,10 +14,12 @@ import (
 
 func main() {
 	imop := gomp.InitOp()
-	dc := gg.NewContext(1024, 768)
+	// Four operators are drawn on every row.
+	height := (len(imop.Ops) + 3) / 4 * 256
+	dc := gg.NewContext(1024, height)
 	dc.Clear()
 	dc.SetRGB(1, 1, 1)
-	dc.DrawRectangle(0, 0, 1024, 768)
+	dc.DrawRectangle(0, 0, 1024, float64(height))
 	dc.Fill()
 
 	// Source image
@@ -74,7 +76,7 @@ func main() {
 		bmp := gomp.NewBitmap(image.Rect(0, 0, size, size))
 		imop.Draw(bmp, srcImg, bdImg, nil)
 
-		strw, _ := dc.MeasureString(op)
+		strw, _ := dc.MeasureString(string(op))
 		dc.DrawImage(bmp.Img, gridX, gridY)
 		dc.DrawRectangle(float64(gridX), float64(gridY), float64(gridX+size), float64(gridY+size))
 		dc.SetRGB(0.6, 0.6, 0.6)
@@ -82,7 +84,7 @@ func main() {
 
 		dc.SetRGB(0.2, 0.2, 0.2)
 		dc.Stroke()
-		dc.DrawString(op, float64(gridX)+(float64(size)/2-strw/2), float64(gridY-10+size))
+		dc.DrawString(string(op), float64(gridX)+(float64(size)/2-strw/2), float64(gridY-10+size))
 
 		gridX += size
 	}
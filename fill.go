@@ -0,0 +1,90 @@
+package gomp
+
+import "fmt"
+
+// SetFill changes the fill opacity of the source, a value between 0 (fully transparent)
+// and 1 (fully opaque). For most of the blend modes the fill opacity is the same as the
+// layer opacity, but for the special blend modes listed in fillModes it's applied inside
+// the blend, by fading the source color towards the neutral color of the blend mode.
+// This reproduces the Fill option of Photoshop, which differs from its Opacity option.
+// The neutral colors are defined for the RGB channels, so in the OKLab blend space the fill
+// opacity of the special blend modes is the same as the layer opacity too.
+func (bl *Blend) SetFill(fill float64) error {
+	if fill < 0 || fill > 1 {
+		return fmt.Errorf("fill opacity should be in the [0, 1] range")
+	}
+	bl.Fill = fill
+	return nil
+}
+
+// SetOpacity changes the layer opacity of the source, a value between 0 (fully transparent)
+// and 1 (fully opaque). It scales the alpha of the blended source, after the fill opacity
+// has been applied, and it's combined with the global opacity of the composition operation.
+func (bl *Blend) SetOpacity(opacity float64) error {
+	if opacity < 0 || opacity > 1 {
+		return fmt.Errorf("opacity should be in the [0, 1] range")
+	}
+	bl.Opacity = opacity
+	return nil
+}
+
+// fillFunc computes a separable blend mode with the source faded by the fill opacity.
+type fillFunc func(s, b, fill float64) float64
+
+// fillModes holds the blend modes for which the fill opacity behaves differently from the layer
+// opacity. Except for Hard Mix, the source color is interpolated towards the neutral color of
+// the blend mode, the one which leaves the backdrop unchanged: white for the burn modes, black
+// for the dodge modes and Difference, and the middle gray for the light modes. Hard Mix has
+// no neutral color, so the fill opacity reduces the contrast of its threshold instead.
+var fillModes = map[BlendMode]fillFunc{
+	ColorBurn: func(s, b, f float64) float64 {
+		return colorBurn(1-f*(1-s), b)
+	},
+	LinearBurn: func(s, b, f float64) float64 {
+		return Max(0, b-f*(1-s))
+	},
+	ColorDodge: func(s, b, f float64) float64 {
+		return colorDodge(f*s, b)
+	},
+	LinearDodge: func(s, b, f float64) float64 {
+		return Min(1, b+f*s)
+	},
+	LinearLight: func(s, b, f float64) float64 {
+		return clampFloat(b+f*(2*s-1), 0, 1)
+	},
+	VividLight: func(s, b, f float64) float64 {
+		return vividLight(0.5+f*(s-0.5), b)
+	},
+	HardMix: func(s, b, f float64) float64 {
+		if f >= 1 {
+			if s+b >= 1 {
+				return 1
+			}
+			return 0
+		}
+		return clampFloat((b-f*(1-s))/(1-f), 0, 1)
+	},
+	Difference: func(s, b, f float64) float64 {
+		return Abs(b - f*s)
+	},
+}
+
+// mixFill is the equivalent of mix for the blend modes listed in fillModes. Over the opaque
+// backdrop the source is blended with the faded color, while over the transparent backdrop,
+// where there's nothing to blend with, the fill opacity scales the alpha of the source.
+func mixFill(fn fillFunc, src, dst Pixel, fill float64) Pixel {
+	cs, cb := src.unpremultiply(), dst.unpremultiply()
+	res := Color{R: fn(cs.R, cb.R, fill), G: fn(cs.G, cb.G, fill), B: fn(cs.B, cb.B, fill)}
+
+	wt, wb := (1-cb.A)*fill, cb.A
+	a := wt + wb
+	if a == 0 {
+		return Pixel{}
+	}
+	return Pixel{
+		R: (wt*cs.R + wb*res.R) / a,
+		G: (wt*cs.G + wb*res.G) / a,
+		B: (wt*cs.B + wb*res.B) / a,
+		A: cs.A * a,
+	}.premultiply()
+}
@@ -0,0 +1,153 @@
+package gomp
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFill_Basic(t *testing.T) {
+	assert := assert.New(t)
+
+	blop := NewBlend()
+	assert.Equal(1.0, blop.Fill)
+	assert.Equal(1.0, blop.Opacity)
+
+	assert.Error(blop.SetFill(-0.1))
+	assert.Error(blop.SetFill(1.1))
+	assert.Error(blop.SetOpacity(-0.1))
+	assert.Error(blop.SetOpacity(1.1))
+	assert.NoError(blop.SetFill(0.3))
+	assert.NoError(blop.SetOpacity(0.7))
+	assert.Equal(0.3, blop.Fill)
+	assert.Equal(0.7, blop.Opacity)
+}
+
+// drawFill composites a single source pixel over a backdrop pixel.
+func drawFill(imop *Comp, blop *Blend, src, dst color.NRGBA) []uint8 {
+	rect := image.Rect(0, 0, 1, 1)
+	bmp := NewBitmap(rect)
+	imop.DrawAt(bmp, rect, image.NewUniform(src), image.Point{}, image.NewUniform(dst), image.Point{}, blop)
+
+	return bmp.Img.Pix
+}
+
+func TestFill_RegularModes(t *testing.T) {
+	assert := assert.New(t)
+
+	imop := InitOp()
+	src := color.NRGBA{R: 250, G: 100, B: 20, A: 200}
+	dst := color.NRGBA{R: 220, G: 120, B: 180, A: 255}
+
+	// For the regular blend modes the fill, the layer opacity and the global opacity are the same.
+	for _, mode := range []BlendMode{Normal, Multiply, Screen, Overlay, SoftLight, Hue, Subtract} {
+		blop := NewBlend()
+		blop.Set(mode)
+		blop.SetFill(0.5)
+		fill := drawFill(imop, blop, src, dst)
+
+		blop.SetFill(1)
+		blop.SetOpacity(0.5)
+		assert.Equalf(fill, drawFill(imop, blop, src, dst), "%s with layer opacity", mode)
+
+		blop.SetOpacity(1)
+		imop.SetOpacity(0.5)
+		assert.Equalf(fill, drawFill(imop, blop, src, dst), "%s with global opacity", mode)
+		imop.SetOpacity(1)
+	}
+}
+
+func TestFill_SpecialModes(t *testing.T) {
+	assert := assert.New(t)
+
+	imop := InitOp()
+	src := color.NRGBA{R: 250, G: 100, B: 20, A: 255}
+	dst := color.NRGBA{R: 220, G: 120, B: 180, A: 255}
+
+	// The expected values at 50% fill and at 50% opacity.
+	tests := []struct {
+		mode    BlendMode
+		fill    []uint8
+		opacity []uint8
+	}{
+		{ColorBurn, []uint8{219, 61, 115, 255}, []uint8{219, 60, 90, 255}},
+		{LinearBurn, []uint8{217, 42, 62, 255}, []uint8{217, 60, 90, 255}},
+		{ColorDodge, []uint8{255, 149, 187, 255}, []uint8{237, 158, 187, 255}},
+		{LinearDodge, []uint8{255, 170, 190, 255}, []uint8{237, 170, 190, 255}},
+		{LinearLight, []uint8{255, 92, 72, 255}, []uint8{237, 92, 90, 255}},
+		{VividLight, []uint8{255, 103, 125, 255}, []uint8{237, 101, 90, 255}},
+		{HardMix, []uint8{255, 84, 125, 255}, []uint8{237, 60, 90, 255}},
+		{Difference, []uint8{95, 70, 170, 255}, []uint8{125, 70, 170, 255}},
+	}
+	for _, tt := range tests {
+		blop := NewBlend()
+		blop.Set(tt.mode)
+		full := drawFill(imop, blop, src, dst)
+
+		blop.SetFill(0.5)
+		res := drawFill(imop, blop, src, dst)
+		assert.Truef(compareBytes(tt.fill, res, 1), "%s at 50%% fill: expected %v, got %v", tt.mode, tt.fill, res)
+
+		blop.SetFill(1)
+		blop.SetOpacity(0.5)
+		res = drawFill(imop, blop, src, dst)
+		assert.Truef(compareBytes(tt.opacity, res, 1), "%s at 50%% opacity: expected %v, got %v", tt.mode, tt.opacity, res)
+
+		// A full fill is the same as not setting it, while an empty one leaves the backdrop unchanged.
+		blop.SetOpacity(1)
+		blop.SetFill(0.999999)
+		assert.Truef(compareBytes(full, drawFill(imop, blop, src, dst), 1), "%s at full fill", tt.mode)
+		blop.SetFill(0)
+		assert.Equalf([]uint8{220, 120, 180, 255}, drawFill(imop, blop, src, dst), "%s at empty fill", tt.mode)
+
+		// The fill is applied before the layer opacity.
+		blop.SetFill(0.5)
+		blop.SetOpacity(0.5)
+		res = drawFill(imop, blop, src, dst)
+		backdrop := []uint8{dst.R, dst.G, dst.B}
+		for i := 0; i < 3; i++ {
+			expected := (float64(backdrop[i]) + float64(tt.fill[i])) / 2
+			assert.InDeltaf(expected, float64(res[i]), 1.5, "%s at 50%% fill and opacity", tt.mode)
+		}
+	}
+}
+
+func TestFill_OKLabSpace(t *testing.T) {
+	assert := assert.New(t)
+
+	imop := InitOp()
+	src := color.NRGBA{R: 250, G: 100, B: 20, A: 255}
+	dst := color.NRGBA{R: 220, G: 120, B: 180, A: 255}
+
+	// In the OKLab space the fill of the special blend modes acts like the layer opacity.
+	for mode := range fillModes {
+		blop := NewBlend()
+		blop.SetSpace(OKLabSpace)
+		blop.Set(mode)
+		blop.SetFill(0.5)
+		fill := drawFill(imop, blop, src, dst)
+
+		blop.SetFill(1)
+		blop.SetOpacity(0.5)
+		assert.Equalf(fill, drawFill(imop, blop, src, dst), "%s with layer opacity", mode)
+	}
+}
+
+func TestFill_TransparentBackdrop(t *testing.T) {
+	assert := assert.New(t)
+
+	imop := InitOp()
+	blop := NewBlend()
+	blop.Set(ColorDodge)
+	blop.SetFill(0.5)
+
+	// Over the transparent backdrop there's nothing to blend with, so the fill scales the alpha.
+	src := color.NRGBA{R: 250, G: 100, B: 20, A: 255}
+	res := drawFill(imop, blop, src, color.NRGBA{})
+	assert.True(compareBytes([]uint8{250, 100, 20, 127}, res, 1))
+
+	blop.Set(Normal)
+	assert.Equal(res, drawFill(imop, blop, src, color.NRGBA{}))
+}
@@ -0,0 +1,209 @@
+package gomp
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// FloatColor represents an alpha-premultiplied color having float32 channels.
+// The channels are normally in the [0, 1] range, but they are not clamped,
+// which makes possible to represent high dynamic range values above 1.0.
+type FloatColor struct {
+	R, G, B, A float32
+}
+
+// RGBA implements the color.Color interface. The channels are clamped
+// into the [0, 1] range, since color.Color cannot represent HDR values.
+func (c FloatColor) RGBA() (r, g, b, a uint32) {
+	alpha := clampFloat(float64(c.A), 0, 1)
+
+	r = uint32(clampFloat(float64(c.R), 0, alpha)*0xffff + 0.5)
+	g = uint32(clampFloat(float64(c.G), 0, alpha)*0xffff + 0.5)
+	b = uint32(clampFloat(float64(c.B), 0, alpha)*0xffff + 0.5)
+	a = uint32(alpha*0xffff + 0.5)
+
+	return
+}
+
+// FloatColorModel is the color model of the FloatRGBA images.
+var FloatColorModel color.Model = color.ModelFunc(floatModel)
+
+func floatModel(c color.Color) color.Color {
+	if c, ok := c.(FloatColor); ok {
+		return c
+	}
+	r, g, b, a := c.RGBA()
+
+	return FloatColor{
+		R: float32(r) / 0xffff,
+		G: float32(g) / 0xffff,
+		B: float32(b) / 0xffff,
+		A: float32(a) / 0xffff,
+	}
+}
+
+// FloatRGBA is an in-memory image whose At method returns FloatColor values.
+// It can be used as a bitmap for linear compositing, because its values are
+// neither quantized nor clamped between consecutive drawing operations.
+type FloatRGBA struct {
+	// Pix holds the image's pixels, in R, G, B, A order. The pixel at
+	// (x, y) starts at Pix[(y-Rect.Min.Y)*Stride + (x-Rect.Min.X)*4].
+	Pix []float32
+	// Stride is the Pix stride between vertically adjacent pixels.
+	Stride int
+	// Rect is the image's bounds.
+	Rect image.Rectangle
+}
+
+// NewFloatRGBA returns a new FloatRGBA image with the given bounds.
+func NewFloatRGBA(r image.Rectangle) *FloatRGBA {
+	return &FloatRGBA{
+		Pix:    make([]float32, 4*r.Dx()*r.Dy()),
+		Stride: 4 * r.Dx(),
+		Rect:   r,
+	}
+}
+
+// ColorModel returns the FloatRGBA color model.
+func (p *FloatRGBA) ColorModel() color.Model {
+	return FloatColorModel
+}
+
+// Bounds returns the domain for which At can return non-zero color.
+func (p *FloatRGBA) Bounds() image.Rectangle {
+	return p.Rect
+}
+
+// At returns the color of the pixel at (x, y).
+func (p *FloatRGBA) At(x, y int) color.Color {
+	return p.FloatAt(x, y)
+}
+
+// FloatAt returns the color of the pixel at (x, y) without any clamping.
+func (p *FloatRGBA) FloatAt(x, y int) FloatColor {
+	if !(image.Point{X: x, Y: y}.In(p.Rect)) {
+		return FloatColor{}
+	}
+	i := p.PixOffset(x, y)
+	s := p.Pix[i : i+4 : i+4]
+
+	return FloatColor{R: s[0], G: s[1], B: s[2], A: s[3]}
+}
+
+// PixOffset returns the index of the first element of Pix
+// that corresponds to the pixel at (x, y).
+func (p *FloatRGBA) PixOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.Stride + (x-p.Rect.Min.X)*4
+}
+
+// Set changes the color of the pixel at (x, y).
+func (p *FloatRGBA) Set(x, y int, c color.Color) {
+	p.SetFloat(x, y, FloatColorModel.Convert(c).(FloatColor))
+}
+
+// SetFloat changes the color of the pixel at (x, y) without any clamping.
+func (p *FloatRGBA) SetFloat(x, y int, c FloatColor) {
+	if !(image.Point{X: x, Y: y}.In(p.Rect)) {
+		return
+	}
+	i := p.PixOffset(x, y)
+	s := p.Pix[i : i+4 : i+4]
+	s[0], s[1], s[2], s[3] = c.R, c.G, c.B, c.A
+}
+
+// SubImage returns an image representing the portion of the image p visible
+// through r. The returned value shares pixels with the original image.
+func (p *FloatRGBA) SubImage(r image.Rectangle) image.Image {
+	r = r.Intersect(p.Rect)
+	if r.Empty() {
+		return &FloatRGBA{}
+	}
+	i := p.PixOffset(r.Min.X, r.Min.Y)
+
+	return &FloatRGBA{
+		Pix:    p.Pix[i:],
+		Stride: p.Stride,
+		Rect:   r,
+	}
+}
+
+// NRGBAToFloat converts an *image.NRGBA image into a FloatRGBA image, keeping the sRGB encoded values.
+// The result is meant for the compositing done on the sRGB values. With the gamma-correct compositing
+// enabled by SetLinear, the FloatRGBA images hold linear values, so use NRGBAToLinearFloat instead.
+func NRGBAToFloat(img *image.NRGBA) *FloatRGBA {
+	return nrgbaToFloat(img, false)
+}
+
+// NRGBAToLinearFloat converts an *image.NRGBA image into a FloatRGBA image,
+// decoding the sRGB encoded colors into linear light. It's the conversion
+// matching the gamma-correct compositing enabled by SetLinear.
+func NRGBAToLinearFloat(img *image.NRGBA) *FloatRGBA {
+	return nrgbaToFloat(img, true)
+}
+
+func nrgbaToFloat(img *image.NRGBA, linear bool) *FloatRGBA {
+	if linear {
+		initGammaTables()
+	}
+	dst := NewFloatRGBA(img.Rect)
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		si := img.PixOffset(img.Rect.Min.X, y)
+		di := dst.PixOffset(dst.Rect.Min.X, y)
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			s := img.Pix[si : si+4 : si+4]
+			p := nrgbaPixel(s[0], s[1], s[2], s[3])
+			if linear {
+				p = p.unpremultiply().toLinear().premultiply()
+			}
+			d := dst.Pix[di : di+4 : di+4]
+			d[0], d[1], d[2], d[3] = float32(p.R), float32(p.G), float32(p.B), float32(p.A)
+			si += 4
+			di += 4
+		}
+	}
+	return dst
+}
+
+// FloatToNRGBA converts a FloatRGBA image holding sRGB encoded values into an *image.NRGBA image.
+// The values outside of the [0, 1] range are clamped. The FloatRGBA images composited with
+// the gamma-correct compositing enabled by SetLinear are converted by LinearFloatToNRGBA.
+func FloatToNRGBA(img *FloatRGBA) *image.NRGBA {
+	return floatToNRGBA(img, false)
+}
+
+// LinearFloatToNRGBA converts a FloatRGBA image holding linear values into an *image.NRGBA image,
+// encoding the colors into sRGB. The values outside of the [0, 1] range are clamped.
+func LinearFloatToNRGBA(img *FloatRGBA) *image.NRGBA {
+	return floatToNRGBA(img, true)
+}
+
+func floatToNRGBA(img *FloatRGBA, linear bool) *image.NRGBA {
+	if linear {
+		initGammaTables()
+	}
+	dst := image.NewNRGBA(img.Rect)
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		si := img.PixOffset(img.Rect.Min.X, y)
+		di := dst.PixOffset(dst.Rect.Min.X, y)
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			s := img.Pix[si : si+4 : si+4]
+			p := Pixel{R: float64(s[0]), G: float64(s[1]), B: float64(s[2]), A: float64(s[3])}
+			putNRGBA(dst.Pix[di:di+4:di+4], p.unpremultiply().clamp(), linear)
+			si += 4
+			di += 4
+		}
+	}
+	return dst
+}
+
+// clampFloat clamps x into the [lo, hi] range. NaN values are converted to lo.
+func clampFloat(x, lo, hi float64) float64 {
+	if math.IsNaN(x) || x < lo {
+		return lo
+	}
+	if x > hi {
+		return hi
+	}
+	return x
+}
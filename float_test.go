@@ -0,0 +1,135 @@
+package gomp
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var _ draw.Image = (*FloatRGBA)(nil)
+
+func TestFloat_Conversion(t *testing.T) {
+	assert := assert.New(t)
+
+	src := makeTestImage(image.Rect(-2, 3, 40, 20), 3)
+	img := NRGBAToFloat(src)
+	assert.Equal(src.Bounds(), img.Bounds())
+	assert.Equal(src.Pix, FloatToNRGBA(img).Pix)
+
+	for _, pt := range []image.Point{{-2, 3}, {10, 10}, {39, 19}} {
+		want := color.RGBA64Model.Convert(src.At(pt.X, pt.Y)).(color.RGBA64)
+		got := color.RGBA64Model.Convert(img.At(pt.X, pt.Y)).(color.RGBA64)
+		assert.InDelta(want.R, got.R, 1)
+		assert.InDelta(want.G, got.G, 1)
+		assert.InDelta(want.B, got.B, 1)
+		assert.InDelta(want.A, got.A, 1)
+	}
+
+	sub := img.SubImage(image.Rect(5, 5, 10, 10)).(*FloatRGBA)
+	assert.Equal(img.FloatAt(5, 5), sub.FloatAt(5, 5))
+	assert.Equal(FloatColor{}, sub.FloatAt(4, 4))
+
+	img.Set(0, 5, color.NRGBA{R: 255, G: 0, B: 0, A: 128})
+	assert.InDelta(128.0/255, img.FloatAt(0, 5).R, 1e-4)
+	assert.InDelta(128.0/255, img.FloatAt(0, 5).A, 1e-4)
+}
+
+func TestFloat_Linear(t *testing.T) {
+	assert := assert.New(t)
+
+	src := makeTestImage(image.Rect(-2, 3, 40, 20), 3)
+	assert.Equal(src.Pix, LinearFloatToNRGBA(NRGBAToLinearFloat(src)).Pix)
+
+	rect := image.Rect(0, 0, 2, 2)
+	gray := image.NewNRGBA(rect)
+	draw.Draw(gray, rect, image.NewUniform(color.NRGBA{R: 128, G: 128, B: 128, A: 255}), image.Point{}, draw.Src)
+
+	imop := InitOp()
+	imop.SetLinear(true)
+	imop.Set(Copy)
+
+	// The linear FloatRGBA images composited in linear mode round trip to the same sRGB values.
+	bmp := NewBitmapFrom(NewFloatRGBA(rect))
+	img := bmp.Image().(*FloatRGBA)
+	imop.DrawAt(bmp, rect, gray, image.Point{}, img, image.Point{}, nil)
+	assert.Equal(gray.Pix, LinearFloatToNRGBA(img).Pix)
+
+	bmp8 := NewBitmap(rect)
+	imop.DrawAt(bmp8, rect, NRGBAToLinearFloat(gray), image.Point{}, bmp8.Img, image.Point{}, nil)
+	assert.Equal(gray.Pix, bmp8.Img.Pix)
+}
+
+func TestFloat_HDR(t *testing.T) {
+	assert := assert.New(t)
+
+	const add CompositeOp = "add"
+
+	imop := InitOp()
+	imop.Register(add, func(src, dst Pixel) Pixel {
+		return Pixel{R: src.R + dst.R, G: src.G + dst.G, B: src.B + dst.B, A: Max(src.A, dst.A)}
+	})
+	imop.Set(add)
+
+	rect := image.Rect(0, 0, 2, 2)
+	source := NewFloatRGBA(rect)
+	draw.Draw(source, rect, &image.Uniform{color.NRGBA{R: 204, G: 102, B: 51, A: 255}}, image.Point{}, draw.Src)
+
+	// The values above 1.0 are kept between consecutive passes.
+	bmp := NewBitmapFrom(NewFloatRGBA(rect))
+	img := bmp.Image().(*FloatRGBA)
+	for i := 0; i < 3; i++ {
+		imop.DrawAt(bmp, rect, source, image.Point{}, img, image.Point{}, nil)
+	}
+	c := img.FloatAt(1, 1)
+	assert.InDelta(2.4, c.R, 1e-5)
+	assert.InDelta(1.2, c.G, 1e-5)
+	assert.InDelta(0.6, c.B, 1e-5)
+	assert.InDelta(1.0, c.A, 1e-5)
+
+	// Converted to color.Color or to *image.NRGBA the values get clamped.
+	assert.Equal(color.RGBA64{R: 0xffff, G: 0xffff, B: 0x9999, A: 0xffff}, color.RGBA64Model.Convert(img.At(1, 1)))
+	assert.Equal([]uint8{255, 255, 153, 255}, FloatToNRGBA(img).Pix[:4])
+
+	// The same passes into an 8-bit bitmap are clamped after every pass.
+	bmp8 := NewBitmap(rect)
+	for i := 0; i < 3; i++ {
+		imop.DrawAt(bmp8, rect, source, image.Point{}, bmp8.Img, image.Point{}, nil)
+	}
+	assert.Equal([]uint8{255, 255, 153, 255}, bmp8.Img.Pix[:4])
+}
+
+func TestFloat_LayerStack(t *testing.T) {
+	assert := assert.New(t)
+
+	rect := image.Rect(0, 0, 1, 1)
+	imop := InitOp()
+	bmp := NewBitmapFrom(NewFloatRGBA(rect))
+	img := bmp.Image().(*FloatRGBA)
+	bmp8 := NewBitmap(rect)
+
+	// Stack many semi-transparent layers, tracking the exact result of the source-over operator.
+	var want Pixel
+	for i := 0; i < 40; i++ {
+		c := color.NRGBA{R: uint8(i * 37 % 256), G: uint8(i * 91 % 256), B: uint8(i * 13 % 256), A: 20}
+		layer := image.NewUniform(c)
+		imop.DrawAt(bmp, rect, layer, image.Point{}, img, image.Point{}, nil)
+		imop.DrawAt(bmp8, rect, layer, image.Point{}, bmp8.Img, image.Point{}, nil)
+
+		s := nrgbaPixel(c.R, c.G, c.B, c.A)
+		want = s.add(want.scale(1 - s.A))
+	}
+
+	got := img.FloatAt(0, 0)
+	assert.InDelta(want.R, got.R, 1e-5)
+	assert.InDelta(want.G, got.G, 1e-5)
+	assert.InDelta(want.B, got.B, 1e-5)
+	assert.InDelta(want.A, got.A, 1e-5)
+
+	// The rounding errors accumulated in the 8-bit bitmap exceed the rounding of a single value.
+	got8 := nrgbaPixel(bmp8.Img.Pix[0], bmp8.Img.Pix[1], bmp8.Img.Pix[2], bmp8.Img.Pix[3])
+	diff := Max(Abs(want.R-got8.R), Abs(want.G-got8.G), Abs(want.B-got8.B))
+	assert.Greater(diff, 0.5/255)
+}
@@ -0,0 +1,124 @@
+package gomp
+
+import (
+	"image"
+	"math"
+	"sync"
+)
+
+// gammaSteps is the number of intervals of the sRGB transfer function lookup tables.
+// It matches the resolution of the 16-bit channels, so the 8-bit and 16-bit values
+// are decoded exactly, while the values in between are linearly interpolated.
+const gammaSteps = 0xffff
+
+var (
+	gammaOnce sync.Once
+	// linearTable maps the sRGB encoded values i/gammaSteps to linear light.
+	linearTable []float64
+	// srgbTable maps the linear light values i/gammaSteps to sRGB encoded values.
+	srgbTable []float64
+)
+
+// initGammaTables builds the sRGB transfer function lookup tables on the first use.
+func initGammaTables() {
+	gammaOnce.Do(func() {
+		linearTable = make([]float64, gammaSteps+2)
+		srgbTable = make([]float64, gammaSteps+2)
+		for i := 0; i <= gammaSteps; i++ {
+			v := float64(i) / gammaSteps
+			linearTable[i] = srgbToLinear(v)
+			srgbTable[i] = linearToSRGB(v)
+		}
+		// The extra entry avoids bounds checks when interpolating the value 1.
+		linearTable[gammaSteps+1] = linearTable[gammaSteps]
+		srgbTable[gammaSteps+1] = srgbTable[gammaSteps]
+	})
+}
+
+// srgbToLinear decodes an sRGB encoded channel into linear light, as defined by IEC 61966-2-1.
+func srgbToLinear(c float64) float64 {
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB encodes a linear light channel with the sRGB transfer function.
+func linearToSRGB(c float64) float64 {
+	if c <= 0.0031308 {
+		return c * 12.92
+	}
+	return 1.055*math.Pow(c, 1/2.4) - 0.055
+}
+
+// lookup interpolates the value of c in one of the transfer function tables.
+func lookup(table []float64, c float64) float64 {
+	c = clampFloat(c, 0, 1) * gammaSteps
+	i := int(c)
+	t := c - float64(i)
+
+	return table[i] + t*(table[i+1]-table[i])
+}
+
+// toLinear decodes the channels of a non-premultiplied pixel from sRGB to linear light.
+func (p Pixel) toLinear() Pixel {
+	return Pixel{
+		R: lookup(linearTable, p.R),
+		G: lookup(linearTable, p.G),
+		B: lookup(linearTable, p.B),
+		A: p.A,
+	}
+}
+
+// toSRGB encodes the channels of a non-premultiplied pixel from linear light to sRGB.
+func (p Pixel) toSRGB() Pixel {
+	return Pixel{
+		R: lookup(srgbTable, p.R),
+		G: lookup(srgbTable, p.G),
+		B: lookup(srgbTable, p.B),
+		A: p.A,
+	}
+}
+
+// toSRGB8 encodes a linear light channel into an 8-bit sRGB value, rounded to the nearest level.
+// The search is done among the decoded 8-bit values, so a channel decoded and encoded again
+// always results in the original value.
+func toSRGB8(c float64) uint8 {
+	// Tolerate the rounding errors, which are far below the smallest step of the table.
+	c += 1e-9
+	lo, hi := 0, 255
+	for lo < hi {
+		k := (lo + hi + 1) / 2
+		if linearTable[k*257] <= c {
+			lo = k
+		} else {
+			hi = k - 1
+		}
+	}
+	// Round up when the channel lies past the middle of the encoded interval above lo.
+	if lo < 255 && c >= lookup(linearTable, (float64(lo)+0.5)/255) {
+		lo++
+	}
+	return uint8(lo)
+}
+
+// decodeStraightRow is the variant of decodeRow for non-premultiplied pixels.
+func decodeStraightRow(img image.Image, buf []Pixel) {
+	if _, ok := img.(*FloatRGBA); ok {
+		return
+	}
+	for k, p := range buf {
+		buf[k] = p.toLinear()
+	}
+}
+
+// decodeRow converts alpha-premultiplied pixels loaded from img into linear light.
+// The *FloatRGBA images already hold linear values, so they are left unchanged.
+func decodeRow(img image.Image, buf []Pixel) {
+	if _, ok := img.(*FloatRGBA); ok {
+		return
+	}
+	for k, p := range buf {
+		buf[k] = p.unpremultiply().toLinear().premultiply()
+	}
+}
@@ -0,0 +1,157 @@
+package gomp
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGamma_TransferFunctions(t *testing.T) {
+	assert := assert.New(t)
+	initGammaTables()
+
+	// Reference values of the sRGB transfer function.
+	assert.InDelta(0.214041140, srgbToLinear(0.5), 1e-9)
+	assert.InDelta(0.735356983, linearToSRGB(0.5), 1e-9)
+	assert.InDelta(0.215860500, lookup(linearTable, 128.0/255), 1e-9)
+	assert.InDelta(0.003035270, lookup(linearTable, 10.0/255), 1e-9)
+	assert.InDelta(0.0, lookup(srgbTable, 0), 1e-9)
+	assert.InDelta(1.0, lookup(srgbTable, 1), 1e-9)
+
+	for i := 0; i <= 10000; i++ {
+		c := float64(i) / 10000
+		assert.InDelta(srgbToLinear(c), lookup(linearTable, c), 1e-7)
+		assert.InDelta(linearToSRGB(c), lookup(srgbTable, c), 1e-7)
+	}
+
+	// The 8-bit values survive a decoding and encoding roundtrip.
+	for k := 0; k < 256; k++ {
+		c := lookup(linearTable, float64(k)/255)
+		assert.Equal(uint8(k), toSRGB8(c))
+		assert.Equal(uint8(k), toSRGB8(c-1e-12))
+	}
+	// The 8-bit encoded values are rounded: 0.5 is encoded as 187.52.
+	assert.Equal(uint8(188), toSRGB8(0.5))
+	for k := 0; k < 255; k++ {
+		mid := srgbToLinear((float64(k) + 0.5) / 255)
+		assert.Equal(uint8(k), toSRGB8(mid-1e-6))
+		assert.Equal(uint8(k+1), toSRGB8(mid+1e-6))
+	}
+}
+
+func TestGamma_Draw(t *testing.T) {
+	assert := assert.New(t)
+
+	rect := image.Rect(0, 0, 4, 4)
+	white := image.NewUniform(color.White)
+	black := image.NewUniform(color.Black)
+
+	imop := InitOp()
+	imop.SetOpacity(0.5)
+
+	// Mixing black and white in equal proportion gives 50% linear light,
+	// which is 0.735357 in sRGB instead of the mid gray of the naive mix.
+	bmp := NewBitmapFrom(image.NewNRGBA64(rect))
+	imop.DrawAt(bmp, rect, white, image.Point{}, black, image.Point{}, nil)
+	assert.Equal(color.NRGBA64{R: 0x8000, G: 0x8000, B: 0x8000, A: 0xffff}, bmp.Image().At(1, 1))
+
+	imop.SetLinear(true)
+	imop.DrawAt(bmp, rect, white, image.Point{}, black, image.Point{}, nil)
+	assert.Equal(color.NRGBA64{R: 48192, G: 48192, B: 48192, A: 0xffff}, bmp.Image().At(1, 1))
+
+	bmp8 := NewBitmap(rect)
+	imop.DrawAt(bmp8, rect, white, image.Point{}, black, image.Point{}, nil)
+	assert.Equal([]uint8{188, 188, 188, 255}, bmp8.Img.Pix[:4])
+
+	// Pure red and green mixed in linear light don't darken into olive.
+	imop.DrawAt(bmp8, rect, image.NewUniform(color.NRGBA{R: 255, A: 255}), image.Point{},
+		image.NewUniform(color.NRGBA{G: 255, A: 255}), image.Point{}, nil)
+	assert.Equal([]uint8{188, 188, 0, 255}, bmp8.Img.Pix[:4])
+
+	// An anti-aliased edge with 50% coverage is as bright as the 50% opacity.
+	imop.SetOpacity(1)
+	mask := image.NewUniform(color.Alpha{A: 128})
+	imop.DrawMask(bmp8, rect, white, image.Point{}, black, image.Point{}, mask, image.Point{}, nil)
+	assert.Equal([]uint8{188, 188, 188, 255}, bmp8.Img.Pix[:4])
+
+	// The blend modes are computed on linear values too:
+	// the mid gray multiplied by itself is 0.2158605² = 0.0465958 in linear light.
+	gray := image.NewUniform(color.NRGBA{R: 128, G: 128, B: 128, A: 255})
+	bl := NewBlend()
+	bl.Set(Multiply)
+	imop.DrawAt(bmp, rect, gray, image.Point{}, gray, image.Point{}, bl)
+	c := bmp.Image().At(1, 1).(color.NRGBA64)
+	assert.InDelta(0.0465958, srgbToLinear(float64(c.R)/0xffff), 1e-6)
+
+	imop.SetLinear(false)
+	imop.DrawAt(bmp, rect, gray, image.Point{}, gray, image.Point{}, bl)
+	c = bmp.Image().At(1, 1).(color.NRGBA64)
+	assert.InDelta(0.2519723, float64(c.R)/0xffff, 1e-6)
+}
+
+func TestGamma_Roundtrip(t *testing.T) {
+	assert := assert.New(t)
+
+	rect := image.Rect(0, 0, 100, 20)
+	src := makeTestImage(rect, 7)
+	dst := makeTestImage(rect, 8)
+
+	imop := InitOp()
+	imop.SetLinear(true)
+
+	// Keeping the backdrop unchanged doesn't alter the 8-bit values.
+	imop.Set(Dst)
+	bmp := NewBitmap(rect)
+	imop.Draw(bmp, src, dst, nil)
+	assert.Equal(dst.Pix, bmp.Img.Pix)
+
+	// Neither do the opaque source pixels drawn over the backdrop.
+	opaque := makeTestImage(rect, 9)
+	for i := 3; i < len(opaque.Pix); i += 4 {
+		opaque.Pix[i] = 0xff
+	}
+	imop.Set(SrcOver)
+	imop.Draw(bmp, opaque, dst, nil)
+	assert.Equal(opaque.Pix, bmp.Img.Pix)
+
+	// The 16-bit images are roundtripped too.
+	src16 := toNRGBA64(src)
+	bmp16 := NewBitmapFrom(image.NewNRGBA64(rect))
+	imop.Set(Copy)
+	imop.DrawAt(bmp16, rect, src16, rect.Min, dst, rect.Min, nil)
+	assert.Equal(src16.Pix, bmp16.Image().(*image.NRGBA64).Pix)
+
+	// The premultiplied images are converted with at most one level of error.
+	rgba := image.NewRGBA(rect)
+	draw.Draw(rgba, rect, src, rect.Min, draw.Src)
+	bmpRGBA := NewBitmapFrom(image.NewRGBA(rect))
+	imop.DrawAt(bmpRGBA, rect, rgba, rect.Min, dst, rect.Min, nil)
+	assert.True(compareBytes(rgba.Pix, bmpRGBA.Image().(*image.RGBA).Pix, 1))
+}
+
+func TestGamma_Float(t *testing.T) {
+	assert := assert.New(t)
+
+	rect := image.Rect(0, 0, 2, 2)
+	imop := InitOp()
+	imop.SetLinear(true)
+	imop.Set(Copy)
+
+	// The FloatRGBA images hold linear values, so the decoded source is stored as it is.
+	src := image.NewUniform(color.NRGBA{R: 128, G: 255, B: 10, A: 255})
+	bmp := NewBitmapFrom(NewFloatRGBA(rect))
+	img := bmp.Image().(*FloatRGBA)
+	imop.DrawAt(bmp, rect, src, image.Point{}, img, image.Point{}, nil)
+	c := img.FloatAt(1, 1)
+	assert.InDelta(0.2158605, c.R, 1e-6)
+	assert.InDelta(1.0, c.G, 1e-6)
+	assert.InDelta(0.0030353, c.B, 1e-6)
+
+	// And they are read back without decoding.
+	bmp8 := NewBitmap(rect)
+	imop.DrawAt(bmp8, rect, img, image.Point{}, img, image.Point{}, nil)
+	assert.Equal([]uint8{128, 255, 10, 255}, bmp8.Img.Pix[:4])
+}
@@ -0,0 +1,313 @@
+package gomp
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// uniformImage returns an image of the provided bounds filled with a single color.
+func uniformImage(r image.Rectangle, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(r)
+	draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+// groupDocument returns a document having an opaque backdrop layer and the provided group above it.
+func groupDocument(group *Layer) *Document {
+	bounds := image.Rect(0, 0, 16, 16)
+	doc := NewDocument(bounds)
+	doc.Add(NewLayer("backdrop", uniformImage(bounds, color.NRGBA{R: 200, G: 100, B: 50, A: 255})), group)
+
+	return doc
+}
+
+func flattenAt(t *testing.T, doc *Document, x, y int) []uint8 {
+	t.Helper()
+
+	bmp, err := doc.Flatten()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := bmp.Img.NRGBAAt(x, y)
+	return []uint8{c.R, c.G, c.B, c.A}
+}
+
+func TestGroup_Basic(t *testing.T) {
+	assert := assert.New(t)
+
+	child := NewLayer("child", uniformImage(image.Rect(0, 0, 4, 4), color.NRGBA{B: 255, A: 255}))
+	group := NewGroup("group", child)
+	assert.Equal(Normal, group.Mode)
+	assert.Equal(SrcOver, group.Op)
+	assert.Equal(1.0, group.Opacity)
+	assert.True(group.Visible)
+	assert.False(group.Group.Isolated)
+	assert.Equal([]*Layer{child}, group.Group.Layers)
+
+	// The offset of the group moves its layers.
+	child.Offset = image.Pt(2, 2)
+	group.Offset = image.Pt(4, 4)
+	doc := groupDocument(group)
+	assert.Equal([]uint8{200, 100, 50, 255}, flattenAt(t, doc, 5, 5))
+	assert.Equal([]uint8{0, 0, 255, 255}, flattenAt(t, doc, 6, 6))
+	assert.Equal([]uint8{0, 0, 255, 255}, flattenAt(t, doc, 9, 9))
+	assert.Equal([]uint8{200, 100, 50, 255}, flattenAt(t, doc, 10, 10))
+
+	// The nested groups and the hidden groups.
+	group.Group.Layers = []*Layer{NewGroup("nested", child)}
+	assert.Equal([]uint8{0, 0, 255, 255}, flattenAt(t, doc, 6, 6))
+	group.Visible = false
+	assert.Equal([]uint8{200, 100, 50, 255}, flattenAt(t, doc, 6, 6))
+
+	// The errors of the nested layers are reported.
+	group.Visible = true
+	child.Mode = "blend_mode_not_supported"
+	_, err := doc.Flatten()
+	assert.Error(err)
+}
+
+func TestGroup_NormalLayers(t *testing.T) {
+	assert := assert.New(t)
+
+	bounds := image.Rect(0, 0, 16, 16)
+	bottom := NewLayer("bottom", uniformImage(image.Rect(0, 0, 10, 10), color.NRGBA{R: 30, G: 200, B: 90, A: 160}))
+	top := NewLayer("top", uniformImage(image.Rect(0, 0, 10, 10), color.NRGBA{R: 250, G: 20, B: 120, A: 100}))
+	top.Offset = image.Pt(6, 6)
+	group := NewGroup("group", bottom, top)
+	doc := groupDocument(group)
+
+	// With the normal blend mode and the source-over operation the two semantics are the same.
+	passThrough, err := doc.Flatten()
+	assert.NoError(err)
+	group.Group.Isolated = true
+	isolated, err := doc.Flatten()
+	assert.NoError(err)
+	assert.True(compareBytes(passThrough.Img.Pix, isolated.Img.Pix, 1))
+
+	// So is flattening the layers without any group.
+	flat := NewDocument(bounds)
+	flat.Add(doc.Layers[0], bottom, top)
+	ungrouped, err := flat.Flatten()
+	assert.NoError(err)
+	assert.Equal(passThrough.Img.Pix, ungrouped.Img.Pix)
+}
+
+func TestGroup_BlendedLayers(t *testing.T) {
+	assert := assert.New(t)
+
+	child := NewLayer("child", uniformImage(image.Rect(0, 0, 8, 8), color.NRGBA{R: 50, G: 150, B: 250, A: 255}))
+	child.Mode = Multiply
+	group := NewGroup("group", child)
+	doc := groupDocument(group)
+
+	// In a pass-through group the layer is multiplied with the backdrop below the group.
+	multiplied := []uint8{200 * 50 / 255, 100 * 150 / 255, 50 * 250 / 255, 255}
+	assert.True(compareBytes(multiplied, flattenAt(t, doc, 2, 2), 1))
+
+	// In an isolated group there's nothing to blend with, so the layer keeps its own color.
+	group.Group.Isolated = true
+	assert.Equal([]uint8{50, 150, 250, 255}, flattenAt(t, doc, 2, 2))
+
+	// The blend mode of an isolated group applies to the group as a unit.
+	child.Mode = Normal
+	group.Mode = Multiply
+	assert.True(compareBytes(multiplied, flattenAt(t, doc, 2, 2), 1))
+
+	// While the blend mode of a pass-through group is ignored.
+	group.Group.Isolated = false
+	assert.Equal([]uint8{50, 150, 250, 255}, flattenAt(t, doc, 2, 2))
+
+	// Outside of the layer the backdrop is unchanged in both cases.
+	assert.Equal([]uint8{200, 100, 50, 255}, flattenAt(t, doc, 12, 12))
+	group.Group.Isolated = true
+	assert.Equal([]uint8{200, 100, 50, 255}, flattenAt(t, doc, 12, 12))
+}
+
+func TestGroup_Opacity(t *testing.T) {
+	assert := assert.New(t)
+
+	child := NewLayer("child", uniformImage(image.Rect(0, 0, 8, 8), color.NRGBA{R: 50, G: 150, B: 250, A: 255}))
+	child.Mode = Difference
+	group := NewGroup("group", child)
+	group.Opacity = 0.5
+	doc := groupDocument(group)
+
+	// The pass-through group mixes the backdrop with the difference.
+	diff := []float64{150, 50, 200}
+	backdrop := []float64{200, 100, 50}
+	res := flattenAt(t, doc, 2, 2)
+	for i := range diff {
+		assert.InDelta((backdrop[i]+diff[i])/2, float64(res[i]), 1)
+	}
+	assert.Equal(uint8(255), res[3])
+
+	// The isolated group mixes the backdrop with the layer itself,
+	// since the difference is computed on a transparent backdrop.
+	group.Group.Isolated = true
+	own := []float64{50, 150, 250}
+	res = flattenAt(t, doc, 2, 2)
+	for i := range own {
+		assert.InDelta((backdrop[i]+own[i])/2, float64(res[i]), 1)
+	}
+	assert.Equal(uint8(255), res[3])
+}
+
+// knockoutDocument returns a document having an opaque backdrop and a group of two overlapping
+// layers: an opaque blue square at (0, 0) and an opaque red square at (6, 6) having 50% opacity.
+func knockoutDocument() (*Document, *Layer) {
+	bottom := NewLayer("bottom", uniformImage(image.Rect(0, 0, 10, 10), color.NRGBA{B: 255, A: 255}))
+	top := NewLayer("top", uniformImage(image.Rect(0, 0, 10, 10), color.NRGBA{R: 255, A: 255}))
+	top.Offset = image.Pt(6, 6)
+	top.Opacity = 0.5
+	group := NewGroup("group", bottom, top)
+
+	return groupDocument(group), group
+}
+
+func TestGroup_Knockout(t *testing.T) {
+	assert := assert.New(t)
+
+	doc, group := knockoutDocument()
+	mix := func(src, dst []float64) []uint8 {
+		return []uint8{uint8((src[0] + dst[0]) / 2), uint8((src[1] + dst[1]) / 2), uint8((src[2] + dst[2]) / 2), 255}
+	}
+	red, blue, backdrop := []float64{255, 0, 0}, []float64{0, 0, 255}, []float64{200, 100, 50}
+
+	for _, isolated := range []bool{false, true} {
+		group.Group.Isolated = isolated
+
+		// Without knockout the top layer is composited over the bottom one.
+		group.Group.Knockout = false
+		assert.Equal([]uint8{0, 0, 255, 255}, flattenAt(t, doc, 2, 2))
+		assert.True(compareBytes(mix(red, blue), flattenAt(t, doc, 8, 8), 1))
+		assert.True(compareBytes(mix(red, backdrop), flattenAt(t, doc, 14, 14), 1))
+
+		// With knockout the top layer replaces the bottom one, showing the backdrop through it.
+		group.Group.Knockout = true
+		assert.Equal([]uint8{0, 0, 255, 255}, flattenAt(t, doc, 2, 2))
+		assert.True(compareBytes(mix(red, backdrop), flattenAt(t, doc, 8, 8), 1))
+		assert.True(compareBytes(mix(red, backdrop), flattenAt(t, doc, 14, 14), 1))
+		assert.Equal([]uint8{200, 100, 50, 255}, flattenAt(t, doc, 2, 14))
+	}
+
+	// The hidden layers don't knock out anything.
+	group.Group.Layers[1].Visible = false
+	assert.Equal([]uint8{0, 0, 255, 255}, flattenAt(t, doc, 8, 8))
+}
+
+func TestGroup_KnockoutShape(t *testing.T) {
+	assert := assert.New(t)
+
+	doc, group := knockoutDocument()
+	top := group.Group.Layers[1]
+	top.Image = uniformImage(image.Rect(0, 0, 10, 10), color.NRGBA{R: 255, A: 128})
+
+	// The top layer has 50% opacity and a shape of 50%, so it only partially knocks out the bottom
+	// one: the result is the bottom layer mixed with the top layer composited over the backdrop.
+	group.Group.Knockout = true
+	res := flattenAt(t, doc, 8, 8)
+	assert.True(compareBytes([]uint8{113, 24, 140, 255}, res, 1), "got %v", res)
+
+	// Without knockout the top layer is composited with an alpha of 25% over the bottom one.
+	group.Group.Knockout = false
+	res = flattenAt(t, doc, 8, 8)
+	assert.True(compareBytes([]uint8{64, 0, 191, 255}, res, 1), "got %v", res)
+
+	// With a full opacity the knockout makes no difference, the shape being the alpha of the layer.
+	top.Opacity = 1
+	res = flattenAt(t, doc, 8, 8)
+	assert.True(compareBytes([]uint8{128, 0, 127, 255}, res, 1), "got %v", res)
+	group.Group.Knockout = true
+	assert.True(compareBytes(res, flattenAt(t, doc, 8, 8), 1))
+}
+
+func TestGroup_KnockoutBlend(t *testing.T) {
+	assert := assert.New(t)
+
+	doc, group := knockoutDocument()
+	group.Group.Knockout = true
+	top := group.Group.Layers[1]
+	top.Image = uniformImage(image.Rect(0, 0, 10, 10), color.NRGBA{R: 255, G: 128, B: 255, A: 255})
+	top.Mode = Multiply
+	top.Opacity = 1
+
+	// The non-isolated knockout group multiplies the top layer with the backdrop of the group.
+	res := flattenAt(t, doc, 8, 8)
+	assert.True(compareBytes([]uint8{200, 50, 50, 255}, res, 1), "got %v", res)
+
+	// Without knockout it multiplies the top layer with the bottom one.
+	group.Group.Knockout = false
+	res = flattenAt(t, doc, 8, 8)
+	assert.True(compareBytes([]uint8{0, 0, 255, 255}, res, 1), "got %v", res)
+
+	// The isolated knockout group multiplies it with the transparent initial backdrop.
+	group.Group.Knockout = true
+	group.Group.Isolated = true
+	res = flattenAt(t, doc, 8, 8)
+	assert.True(compareBytes([]uint8{255, 128, 255, 255}, res, 1), "got %v", res)
+}
+
+func TestGroup_KnockoutNested(t *testing.T) {
+	assert := assert.New(t)
+
+	doc, group := knockoutDocument()
+	group.Group.Knockout = true
+	top := group.Group.Layers[1]
+
+	// A nested group is knocked out as a unit, using the opacity of the group layer.
+	top.Opacity = 1
+	nested := NewGroup("nested", top)
+	nested.Opacity = 0.5
+	group.Group.Layers[1] = nested
+	res := flattenAt(t, doc, 8, 8)
+	assert.True(compareBytes([]uint8{227, 50, 25, 255}, res, 1), "got %v", res)
+}
+
+func TestGroup_KnockoutNestedPassThrough(t *testing.T) {
+	assert := assert.New(t)
+
+	doc, group := knockoutDocument()
+	group.Group.Knockout = true
+	top := group.Group.Layers[1]
+	top.Image = uniformImage(image.Rect(0, 0, 10, 10), color.NRGBA{R: 255, G: 128, B: 255, A: 255})
+	top.Mode = Multiply
+	top.Opacity = 1
+
+	// The layers of a nested pass-through group blend with the initial backdrop of the
+	// knockout group, while the mode and the operation of the nested group are ignored.
+	nested := NewGroup("nested", top)
+	nested.Mode = Screen
+	nested.Op = Xor
+	group.Group.Layers[1] = nested
+	res := flattenAt(t, doc, 8, 8)
+	assert.True(compareBytes([]uint8{200, 50, 50, 255}, res, 1), "got %v", res)
+	assert.Equal([]uint8{0, 0, 255, 255}, flattenAt(t, doc, 2, 2))
+
+	// A nested isolated group is blended as a unit, using its own mode.
+	nested.Op = SrcOver
+	nested.Group.Isolated = true
+	res = flattenAt(t, doc, 8, 8)
+	assert.True(compareBytes([]uint8{255, 178, 255, 255}, res, 1), "got %v", res)
+}
+
+func TestGroup_KnockoutUnbounded(t *testing.T) {
+	assert := assert.New(t)
+
+	doc, group := knockoutDocument()
+	top := group.Group.Layers[1]
+	top.Op = SrcIn
+
+	// Outside of the top layer the source-in operation clears the backdrop,
+	// with and without knockout, as it does for the ungrouped layers.
+	for _, knockout := range []bool{false, true} {
+		group.Group.Knockout = knockout
+		assert.Equal([]uint8{0, 0, 0, 0}, flattenAt(t, doc, 2, 2), "knockout %v", knockout)
+		assert.Equal([]uint8{0, 0, 0, 0}, flattenAt(t, doc, 2, 14), "knockout %v", knockout)
+		res := flattenAt(t, doc, 8, 8)
+		assert.True(compareBytes([]uint8{255, 0, 0, 128}, res, 1), "knockout %v: got %v", knockout, res)
+	}
+}
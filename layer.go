@@ -0,0 +1,334 @@
+package gomp
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Layer is an image composited on a document. Offset is the position of the top-left corner of
+// the image in the document, Mode is the blend mode, an empty value disabling the blending, while
+// Op is the composition operation. Opacity ranges from 0 (fully transparent) to 1 (fully opaque),
+// and it's used as the global opacity of the composition operation. The layers which are not
+// Visible are skipped when the document is flattened. If Group is set, the content of the layer
+// is the group of nested layers instead of the image, see NewGroup.
+type Layer struct {
+	Name    string
+	Image   image.Image
+	Offset  image.Point
+	Mode    BlendMode
+	Op      CompositeOp
+	Opacity float64
+	Visible bool
+	Group   *Group
+}
+
+// Group is a stack of nested layers, ordered from the bottom to the top. The group is rendered
+// following the transparency models of W3C and PDF, depending on whether it's Isolated or not:
+//
+// An isolated group is composited on a transparent backdrop first, then the result is blended
+// and composited as a unit with what lies below, using the mode, the operation and the opacity
+// of the group layer. This is the behavior of the groups having the isolation property in CSS.
+//
+// A non-isolated group, known as pass-through in Photoshop, is composited directly on what lies
+// below, so its layers blend with the backdrop of the group. The result is then mixed with the
+// backdrop depending on the opacity of the group layer, while its mode and operation are ignored.
+//
+// In a Knockout group each layer is composited only with the initial backdrop of the group, which
+// is transparent for the isolated groups, and not with the layers below it in the group. The result
+// replaces the one of the layers below depending on the shape of the layer, which is the alpha
+// of its content, while the opacity of the layer is applied when compositing with the backdrop.
+// The nested groups are knocked out as units, their shape being the alpha of their layers, and
+// they keep their own semantics: a nested pass-through group is composited directly on the initial
+// backdrop, ignoring its mode and operation. The layers using an operation which changes the backdrop
+// outside of the source, like SrcIn, knock out the whole group. Without knockout the layers are
+// composited in turn.
+type Group struct {
+	Layers   []*Layer
+	Isolated bool
+	Knockout bool
+}
+
+// Document is a stack of layers, ordered from the bottom to the top, rendered into a bitmap having
+// the size of Bounds. Comp and Blend hold the composition operations and the blend modes available
+// for the layers, together with the options shared by all the layers, like the gamma-correct
+// compositing, the number of workers or the blend space.
+type Document struct {
+	Bounds image.Rectangle
+	Layers []*Layer
+	Comp   *Comp
+	Blend  *Blend
+}
+
+// NewLayer initializes a new visible and fully opaque layer, composited with
+// the source-over operation and the normal blend mode at the origin of the document.
+func NewLayer(name string, img image.Image) *Layer {
+	return &Layer{
+		Name:    name,
+		Image:   img,
+		Mode:    Normal,
+		Op:      SrcOver,
+		Opacity: 1,
+		Visible: true,
+	}
+}
+
+// NewGroup initializes a new visible and fully opaque group layer holding the provided layers.
+// The group is not isolated, the Isolated field of the group changing this behavior.
+func NewGroup(name string, layers ...*Layer) *Layer {
+	l := NewLayer(name, nil)
+	l.Group = &Group{Layers: layers}
+
+	return l
+}
+
+// NewDocument initializes a new empty document.
+func NewDocument(bounds image.Rectangle) *Document {
+	return &Document{
+		Bounds: bounds,
+		Comp:   InitOp(),
+		Blend:  NewBlend(),
+	}
+}
+
+// Add adds the layers on the top of the stack.
+func (doc *Document) Add(layers ...*Layer) {
+	doc.Layers = append(doc.Layers, layers...)
+}
+
+// Flatten renders the visible layers from the bottom to the top on a transparent
+// backdrop and returns the result. The layers are composited with 16-bit precision,
+// so the rounding errors don't accumulate along the stack.
+func (doc *Document) Flatten() (*Bitmap, error) {
+	work := image.NewNRGBA64(doc.Bounds)
+	if err := doc.render(work, doc.Layers, image.Point{}); err != nil {
+		return nil, err
+	}
+	// The 16-bit result is converted by copying it with the drawing methods, which round
+	// the channels to the nearest 8-bit value, while draw.Draw would truncate them.
+	op := InitOp()
+	op.Set(Copy)
+	op.SetWorkers(doc.Comp.Workers)
+	bmp := NewBitmap(doc.Bounds)
+	op.DrawAt(bmp, doc.Bounds, work, doc.Bounds.Min, work, doc.Bounds.Min, nil)
+
+	return bmp, nil
+}
+
+// render composites the layers in place over the image, moving them by the offset.
+func (doc *Document) render(img draw.Image, layers []*Layer, offset image.Point) error {
+	bmp := NewBitmapFrom(img)
+	for _, l := range layers {
+		if !l.Visible {
+			continue
+		}
+		if l.Group != nil {
+			if err := doc.renderGroup(img, l, offset); err != nil {
+				return err
+			}
+			continue
+		}
+		if l.Image == nil {
+			continue
+		}
+		op, bl, err := doc.setup(l)
+		if err != nil {
+			return err
+		}
+		ib := l.Image.Bounds()
+		r := ib.Sub(ib.Min).Add(l.Offset).Add(offset)
+		op.DrawAt(bmp, r, l.Image, ib.Min, img, r.Min, bl)
+
+		// Outside of its image the layer is transparent, which
+		// changes the backdrop for some of the composition operations.
+		if !bounded(op) {
+			for _, o := range outside(img.Bounds(), r) {
+				op.DrawAt(bmp, o, image.Transparent, image.Point{}, img, o.Min, bl)
+			}
+		}
+	}
+	return nil
+}
+
+// renderGroup composites a group layer in place over the image, moving it by the offset.
+func (doc *Document) renderGroup(img draw.Image, l *Layer, offset image.Point) error {
+	op, bl, err := doc.setup(l)
+	if err != nil {
+		return err
+	}
+	bounds := img.Bounds()
+	offset = offset.Add(l.Offset)
+
+	if l.Group.Isolated {
+		group := image.NewNRGBA64(bounds)
+		if err := doc.renderGroupLayers(group, l.Group, offset); err != nil {
+			return err
+		}
+		op.DrawAt(NewBitmapFrom(img), bounds, group, bounds.Min, img, bounds.Min, bl)
+		return nil
+	}
+
+	if l.Opacity >= 1 {
+		return doc.renderGroupLayers(img, l.Group, offset)
+	}
+	backdrop := image.NewNRGBA64(bounds)
+	draw.Draw(backdrop, bounds, img, bounds.Min, draw.Src)
+	if err := doc.renderGroupLayers(img, l.Group, offset); err != nil {
+		return err
+	}
+	doc.lerpImage(img, backdrop, l.Opacity)
+
+	return nil
+}
+
+// lerpImage interpolates in place between the backdrop and the image depending on t, the result
+// being img × t + backdrop × (1 - t). The backdrop is overwritten. It's drawn with a copy of the
+// composition operation of the document, so it follows its options, like the gamma-correct compositing.
+func (doc *Document) lerpImage(img, backdrop draw.Image, t float64) {
+	bounds := img.Bounds()
+	op := *doc.Comp
+	op.Channels = AllChannels
+
+	// The destination-in operation scales the backdrop by the opacity of the opaque source.
+	op.Set(DstIn)
+	op.Opacity = 1 - t
+	op.DrawAt(NewBitmapFrom(backdrop), bounds, image.Opaque, image.Point{}, backdrop, bounds.Min, nil)
+	op.Set(Plus)
+	op.Opacity = t
+	op.DrawAt(NewBitmapFrom(img), bounds, img, bounds.Min, backdrop, bounds.Min, nil)
+}
+
+// renderGroupLayers composites the layers of a group in place over its backdrop.
+func (doc *Document) renderGroupLayers(img draw.Image, g *Group, offset image.Point) error {
+	if !g.Knockout {
+		return doc.render(img, g.Layers, offset)
+	}
+	bounds := img.Bounds()
+	initial := image.NewNRGBA64(bounds)
+	draw.Draw(initial, bounds, img, bounds.Min, draw.Src)
+	result := image.NewNRGBA64(bounds)
+
+	for _, l := range g.Layers {
+		if !l.Visible || (l.Image == nil && l.Group == nil) {
+			continue
+		}
+		// The layer composited with the initial backdrop of the group, following
+		// the semantics of the isolated and of the pass-through nested groups.
+		draw.Draw(result, bounds, initial, bounds.Min, draw.Src)
+		if err := doc.render(result, []*Layer{l}, offset); err != nil {
+			return err
+		}
+		op, _, err := doc.setup(l)
+		if err != nil {
+			return err
+		}
+		pos := l.Offset.Add(offset)
+		switch {
+		case !bounded(op) && (l.Group == nil || l.Group.Isolated):
+			// The unbounded operations change the backdrop outside of the layer too,
+			// so the layer replaces the result of the layers below everywhere.
+			doc.knockOut(img, bounds, result, initial, nil, image.Point{})
+		case l.Group != nil:
+			// The shape of a nested group is the alpha of its layers composited on their own.
+			shape := image.NewNRGBA64(bounds)
+			if err := doc.renderGroupLayers(shape, l.Group, pos); err != nil {
+				return err
+			}
+			doc.knockOut(img, bounds, result, initial, shape, bounds.Min)
+		default:
+			ib := l.Image.Bounds()
+			doc.knockOut(img, ib.Sub(ib.Min).Add(pos), result, initial, l.Image, ib.Min)
+		}
+	}
+	return nil
+}
+
+// knockOut replaces in place the result of the layers below with the result of a knocked-out
+// layer, depending on the shape of the layer: img = result + (1 - shape) × (img - initial), where
+// result is the layer composited over the initial backdrop of the group. Where the shape is opaque
+// the layers below are knocked out, while where it's transparent they are kept. The shape point sp
+// is aligned with r.Min, and a nil shape is treated as fully opaque.
+func (doc *Document) knockOut(img draw.Image, r image.Rectangle, result, initial, shape image.Image, sp image.Point) {
+	clipped := r.Intersect(img.Bounds())
+	if clipped.Empty() {
+		return
+	}
+	sp = sp.Add(clipped.Min.Sub(r.Min))
+	r = clipped
+
+	linear := doc.Comp.Linear
+	if linear {
+		initGammaTables()
+	}
+	n := r.Dx()
+	below, res, init := make([]Pixel, n), make([]Pixel, n), make([]Pixel, n)
+	cover := make([]float64, n)
+	for k := range cover {
+		cover[k] = 1
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		loadRow(img, r.Min.X, y, below)
+		loadRow(result, r.Min.X, y, res)
+		loadRow(initial, r.Min.X, y, init)
+		if linear {
+			decodeRow(img, below)
+			decodeRow(result, res)
+			decodeRow(initial, init)
+		}
+		if shape != nil {
+			loadAlphaRow(shape, sp.X, sp.Y+y-r.Min.Y, cover)
+		}
+		for k, p := range res {
+			kept := below[k].add(init[k].scale(-1)).scale(1 - cover[k])
+			res[k] = p.add(kept).clampPremultiplied()
+		}
+		storeRow(img, r.Min.X, y, res, linear)
+	}
+}
+
+// setup returns the composition operation and the blend mode of a layer. These are copies
+// of the ones of the document, so the layers can be rendered without altering them.
+func (doc *Document) setup(l *Layer) (*Comp, *Blend, error) {
+	op := *doc.Comp
+	if err := op.Set(l.Op); err != nil {
+		return nil, nil, err
+	}
+	if err := op.SetOpacity(l.Opacity); err != nil {
+		return nil, nil, err
+	}
+	if l.Mode == "" {
+		return &op, nil, nil
+	}
+	bl := *doc.Blend
+	if err := bl.Set(l.Mode); err != nil {
+		return nil, nil, err
+	}
+	return &op, &bl, nil
+}
+
+// bounded reports whether the current composition operation leaves
+// the backdrop unchanged where the source is transparent.
+func bounded(op *Comp) bool {
+	d := Pixel{R: 0.25, G: 0.5, B: 0.125, A: 0.5}
+	return op.funcs[op.CurrentOp](Pixel{}, d) == d
+}
+
+// outside returns the parts of the bounds which are not covered by the rectangle r.
+func outside(bounds, r image.Rectangle) []image.Rectangle {
+	r = r.Intersect(bounds)
+	if r.Empty() {
+		return []image.Rectangle{bounds}
+	}
+	rects := []image.Rectangle{
+		image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Max.X, r.Min.Y),
+		image.Rect(bounds.Min.X, r.Max.Y, bounds.Max.X, bounds.Max.Y),
+		image.Rect(bounds.Min.X, r.Min.Y, r.Min.X, r.Max.Y),
+		image.Rect(r.Max.X, r.Min.Y, bounds.Max.X, r.Max.Y),
+	}
+	res := rects[:0]
+	for _, o := range rects {
+		if !o.Empty() {
+			res = append(res, o)
+		}
+	}
+	return res
+}
@@ -0,0 +1,155 @@
+package gomp
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLayer_Basic(t *testing.T) {
+	assert := assert.New(t)
+
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	l := NewLayer("background", img)
+	assert.Equal("background", l.Name)
+	assert.Equal(Normal, l.Mode)
+	assert.Equal(SrcOver, l.Op)
+	assert.Equal(1.0, l.Opacity)
+	assert.True(l.Visible)
+
+	doc := NewDocument(image.Rect(0, 0, 8, 8))
+	doc.Add(l, NewLayer("top", img))
+	assert.Len(doc.Layers, 2)
+	assert.Equal("top", doc.Layers[1].Name)
+
+	// An empty document is flattened into a transparent bitmap.
+	bmp, err := NewDocument(image.Rect(0, 0, 8, 8)).Flatten()
+	assert.NoError(err)
+	assert.Equal(make([]uint8, 8*8*4), bmp.Img.Pix)
+
+	// The invalid settings of the layers are reported.
+	l.Mode = "blend_mode_not_supported"
+	_, err = doc.Flatten()
+	assert.Error(err)
+	l.Mode = Normal
+	l.Opacity = 2
+	_, err = doc.Flatten()
+	assert.Error(err)
+}
+
+func TestLayer_Flatten(t *testing.T) {
+	assert := assert.New(t)
+
+	bounds := image.Rect(0, 0, 64, 48)
+	background := makeTestImage(bounds, 3)
+	for i := 3; i < len(background.Pix); i += 4 {
+		background.Pix[i] = 255
+	}
+	middle := makeTestImage(image.Rect(0, 0, 32, 32), 5)
+	top := makeTestImage(image.Rect(10, 10, 30, 50), 7)
+
+	doc := NewDocument(bounds)
+	doc.Add(NewLayer("background", background))
+
+	l := NewLayer("middle", middle)
+	l.Offset = image.Pt(8, 4)
+	l.Mode = Multiply
+	l.Opacity = 0.5
+	doc.Add(l)
+
+	l = NewLayer("top", top)
+	l.Offset = image.Pt(40, 20)
+	l.Mode = Screen
+	l.Op = SrcAtop
+	doc.Add(l)
+
+	bmp, err := doc.Flatten()
+	assert.NoError(err)
+
+	// The same stack composited by chaining the drawing methods.
+	work := image.NewNRGBA64(bounds)
+	ref := NewBitmapFrom(work)
+	imop := InitOp()
+	blop := NewBlend()
+
+	blop.Set(Normal)
+	imop.DrawAt(ref, bounds, background, image.Point{}, work, image.Point{}, blop)
+
+	blop.Set(Multiply)
+	imop.SetOpacity(0.5)
+	r := image.Rect(8, 4, 40, 36)
+	imop.DrawAt(ref, r, middle, image.Point{}, work, r.Min, blop)
+
+	blop.Set(Screen)
+	imop.Set(SrcAtop)
+	imop.SetOpacity(1)
+	r = image.Rect(40, 20, 60, 60)
+	imop.DrawAt(ref, r, top, top.Bounds().Min, work, r.Min, blop)
+
+	expected := NewBitmap(bounds)
+	imop.Set(Copy)
+	imop.DrawAt(expected, bounds, work, image.Point{}, work, image.Point{}, nil)
+	assert.Equal(expected.Img.Pix, bmp.Img.Pix)
+
+	// The hidden layers are skipped.
+	doc.Layers[1].Visible = false
+	hidden, err := doc.Flatten()
+	assert.NoError(err)
+	doc.Layers = append(doc.Layers[:1], doc.Layers[2:]...)
+	removed, err := doc.Flatten()
+	assert.NoError(err)
+	assert.Equal(removed.Img.Pix, hidden.Img.Pix)
+	assert.NotEqual(bmp.Img.Pix, hidden.Img.Pix)
+}
+
+func TestLayer_FlattenSingle(t *testing.T) {
+	assert := assert.New(t)
+
+	// A single layer comes back unchanged, the 16-bit result being rounded to the 8-bit values.
+	img := makeTestImage(image.Rect(0, 0, 64, 64), 3)
+	doc := NewDocument(img.Bounds())
+	doc.Add(NewLayer("layer", img))
+
+	bmp, err := doc.Flatten()
+	assert.NoError(err)
+	assert.Equal(img.Pix, bmp.Img.Pix)
+
+	doc.Comp.SetLinear(true)
+	bmp, err = doc.Flatten()
+	assert.NoError(err)
+	assert.Equal(img.Pix, bmp.Img.Pix)
+}
+
+func TestLayer_Unbounded(t *testing.T) {
+	assert := assert.New(t)
+
+	bounds := image.Rect(0, 0, 8, 8)
+	red := image.NewNRGBA(bounds)
+	draw.Draw(red, red.Bounds(), image.NewUniform(color.NRGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+	blue := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	draw.Draw(blue, blue.Bounds(), image.NewUniform(color.NRGBA{B: 255, A: 255}), image.Point{}, draw.Src)
+
+	doc := NewDocument(bounds)
+	doc.Add(NewLayer("red", red))
+
+	l := NewLayer("blue", blue)
+	l.Offset = image.Pt(2, 2)
+	doc.Add(l)
+
+	// With source-over the backdrop is kept outside of the layer.
+	bmp, err := doc.Flatten()
+	assert.NoError(err)
+	assert.Equal(color.NRGBA{R: 255, A: 255}, bmp.Img.NRGBAAt(0, 0))
+	assert.Equal(color.NRGBA{B: 255, A: 255}, bmp.Img.NRGBAAt(3, 3))
+
+	// The layer is transparent outside of its image, so source-in clears the backdrop there.
+	l.Op = SrcIn
+	bmp, err = doc.Flatten()
+	assert.NoError(err)
+	assert.Equal(color.NRGBA{}, bmp.Img.NRGBAAt(0, 0))
+	assert.Equal(color.NRGBA{}, bmp.Img.NRGBAAt(7, 7))
+	assert.Equal(color.NRGBA{B: 255, A: 255}, bmp.Img.NRGBAAt(3, 3))
+}
@@ -0,0 +1,170 @@
+package gomp
+
+import (
+	"fmt"
+	"math"
+)
+
+// ColorModel is the name of the color model used by the non-separable blend modes
+// (Hue, Saturation, ColorMode and Luminosity) for splitting a color into its hue,
+// saturation and lightness components.
+type ColorModel string
+
+const (
+	// W3CModel uses the SetLum and SetSat functions of the W3C specification. It's the default.
+	W3CModel ColorModel = "w3c"
+	// HSLModel uses the hue, saturation and lightness components.
+	HSLModel ColorModel = "hsl"
+	// HSVModel uses the hue, saturation and value components.
+	HSVModel ColorModel = "hsv"
+	// OKLChModel uses the hue, chroma and lightness components of the OKLab perceptual color space.
+	// With the gamma-correct compositing the colors are converted from linear light, see Comp.SetLinear.
+	OKLChModel ColorModel = "oklch"
+)
+
+// LumCoeffs holds the weights of the red, green and blue channels in the luminosity of a color.
+type LumCoeffs struct {
+	R, G, B float64
+}
+
+var (
+	// W3CLum holds the coefficients defined by the W3C specification. They are the default ones.
+	W3CLum = LumCoeffs{R: 0.3, G: 0.59, B: 0.11}
+	// Rec709Lum holds the coefficients of the ITU-R BT.709 standard used by HDTV.
+	Rec709Lum = LumCoeffs{R: 0.2126, G: 0.7152, B: 0.0722}
+	// Rec2020Lum holds the coefficients of the ITU-R BT.2020 standard used by UHDTV.
+	Rec2020Lum = LumCoeffs{R: 0.2627, G: 0.6780, B: 0.0593}
+)
+
+// SetLumCoeffs changes the coefficients used for computing the luminosity of a color.
+// The coefficients cannot be negative and their sum should be 1.
+func (bl *Blend) SetLumCoeffs(c LumCoeffs) error {
+	if c.R < 0 || c.G < 0 || c.B < 0 {
+		return fmt.Errorf("the luminosity coefficients cannot be negative")
+	}
+	if Abs(c.R+c.G+c.B-1) > 1e-6 {
+		return fmt.Errorf("the sum of the luminosity coefficients should be 1")
+	}
+	bl.Coeffs = c
+	return nil
+}
+
+// SetColorModel changes the color model used by the non-separable blend modes.
+func (bl *Blend) SetColorModel(m ColorModel) error {
+	switch m {
+	case W3CModel, HSLModel, HSVModel, OKLChModel:
+		bl.Model = m
+		return nil
+	}
+	return fmt.Errorf("unsupported color model")
+}
+
+// cylindricalModel converts colors between RGB and a color model
+// having a hue, a saturation (or chroma) and a lightness (or value) component.
+type cylindricalModel struct {
+	to   func(c Color) (h, s, l float64)
+	from func(h, s, l float64) Color
+}
+
+var (
+	hslModel   = cylindricalModel{to: rgbToHSL, from: hslToRGB}
+	hsvModel   = cylindricalModel{to: rgbToHSV, from: hsvToRGB}
+	oklchModel = cylindricalModel{to: rgbToOKLCh, from: okLChToRGB}
+	// oklchLinearModel is the OKLCh model of the gamma-correct compositing.
+	oklchLinearModel = cylindricalModel{to: linearToOKLCh, from: okLChToLinear}
+)
+
+// cylindrical returns the cylindrical color model used by the non-separable blend modes,
+// or false if the components are computed as defined by the W3C specification.
+// In the OKLab blend space the OKLCh components are always used.
+func (bl *Blend) cylindrical() (cylindricalModel, bool) {
+	if bl.Space == OKLabSpace {
+		return labPixelModel, true
+	}
+	switch bl.Model {
+	case HSLModel:
+		return hslModel, true
+	case HSVModel:
+		return hsvModel, true
+	case OKLChModel:
+		if bl.linear {
+			return oklchLinearModel, true
+		}
+		return oklchModel, true
+	}
+	return cylindricalModel{}, false
+}
+
+// achromatic is the saturation below which the hue of a color is considered undefined.
+const achromatic = 1e-6
+
+// hue returns the hue of a color in the [0, 1) range, together with its maximum and minimum channels.
+func hue(c Color) (h, max, min float64) {
+	max, min = Max(c.R, c.G, c.B), Min(c.R, c.G, c.B)
+	d := max - min
+	if d == 0 {
+		return 0, max, min
+	}
+	switch max {
+	case c.R:
+		h = (c.G - c.B) / d
+		if h < 0 {
+			h += 6
+		}
+	case c.G:
+		h = (c.B-c.R)/d + 2
+	default:
+		h = (c.R-c.G)/d + 4
+	}
+	return h / 6, max, min
+}
+
+// hueToRGB returns the color having the hue h, the chroma c, and the minimum channel m.
+func hueToRGB(h, c, m float64) Color {
+	h = (h - math.Floor(h)) * 6
+	x := c * (1 - Abs(math.Mod(h, 2)-1))
+
+	var r, g, b float64
+	switch {
+	case h < 1:
+		r, g = c, x
+	case h < 2:
+		r, g = x, c
+	case h < 3:
+		g, b = c, x
+	case h < 4:
+		g, b = x, c
+	case h < 5:
+		r, b = x, c
+	default:
+		r, b = c, x
+	}
+	return Color{R: r + m, G: g + m, B: b + m}
+}
+
+func rgbToHSL(c Color) (h, s, l float64) {
+	h, max, min := hue(c)
+	l = (max + min) / 2
+	if max > min {
+		s = (max - min) / (1 - Abs(2*l-1))
+	}
+	return h, s, l
+}
+
+func hslToRGB(h, s, l float64) Color {
+	c := (1 - Abs(2*l-1)) * s
+	return hueToRGB(h, c, l-c/2)
+}
+
+func rgbToHSV(c Color) (h, s, v float64) {
+	h, max, min := hue(c)
+	if max > 0 {
+		s = (max - min) / max
+	}
+	return h, s, max
+}
+
+func hsvToRGB(h, s, v float64) Color {
+	c := v * s
+	return hueToRGB(h, c, v-c)
+}
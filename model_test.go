@@ -0,0 +1,186 @@
+package gomp
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModel_LumCoeffs(t *testing.T) {
+	assert := assert.New(t)
+
+	blop := NewBlend()
+	green := Color{R: 0, G: 1, B: 0}
+	assert.InDelta(0.59, blop.Lum(green), 1e-9)
+
+	err := blop.SetLumCoeffs(Rec709Lum)
+	assert.NoError(err)
+	assert.InDelta(0.7152, blop.Lum(green), 1e-9)
+
+	err = blop.SetLumCoeffs(Rec2020Lum)
+	assert.NoError(err)
+	assert.InDelta(0.678, blop.Lum(green), 1e-9)
+
+	// The invalid coefficients are rejected, keeping the previous ones.
+	assert.Error(blop.SetLumCoeffs(LumCoeffs{R: -0.1, G: 0.6, B: 0.5}))
+	assert.Error(blop.SetLumCoeffs(LumCoeffs{R: 0.3, G: 0.3, B: 0.3}))
+	assert.Equal(Rec2020Lum, blop.Coeffs)
+
+	// The zero value falls back to the W3C coefficients.
+	blop = &Blend{}
+	assert.InDelta(0.59, blop.Lum(green), 1e-9)
+}
+
+func TestModel_LumCoeffsBlend(t *testing.T) {
+	assert := assert.New(t)
+
+	blop := NewBlend()
+	blop.Set(Luminosity)
+
+	src := color.NRGBA{R: 0, G: 255, B: 0, A: 255}
+	dst := color.NRGBA{R: 128, G: 128, B: 128, A: 255}
+
+	// The luminosity of the green source is transferred to the gray backdrop.
+	expected := []uint8{150, 150, 150, 255}
+	assert.True(compareBytes(expected, blendModel(blop, src, dst), 1))
+
+	blop.SetLumCoeffs(Rec709Lum)
+	expected = []uint8{182, 182, 182, 255}
+	assert.True(compareBytes(expected, blendModel(blop, src, dst), 1))
+}
+
+func TestModel_ColorModels(t *testing.T) {
+	assert := assert.New(t)
+
+	blop := NewBlend()
+	assert.Equal(W3CModel, blop.Model)
+	assert.Error(blop.SetColorModel("lab"))
+	assert.Equal(W3CModel, blop.Model)
+
+	red := color.NRGBA{R: 255, G: 0, B: 0, A: 255}
+	gray := color.NRGBA{R: 128, G: 128, B: 128, A: 255}
+	// The backdrop has a hue of 150°, a HSL saturation of 0.5 and a lightness of 0.4.
+	backdrop := color.NRGBA{R: 51, G: 153, B: 102, A: 255}
+
+	tests := []struct {
+		model    ColorModel
+		mode     BlendMode
+		src      color.NRGBA
+		expected []uint8
+	}{
+		{HSLModel, Hue, red, []uint8{153, 51, 51, 255}},
+		{HSLModel, Hue, gray, []uint8{51, 153, 102, 255}},
+		{HSLModel, Saturation, gray, []uint8{102, 102, 102, 255}},
+		{HSLModel, ColorMode, red, []uint8{204, 0, 0, 255}},
+		{HSLModel, Luminosity, red, []uint8{64, 191, 128, 255}},
+		{HSVModel, Saturation, red, []uint8{0, 153, 77, 255}},
+		{HSVModel, ColorMode, red, []uint8{153, 0, 0, 255}},
+		{HSVModel, Luminosity, gray, []uint8{43, 128, 85, 255}},
+	}
+	for _, tt := range tests {
+		assert.NoError(blop.SetColorModel(tt.model))
+		blop.Set(tt.mode)
+
+		res := blendModel(blop, tt.src, backdrop)
+		assert.Truef(compareBytes(tt.expected, res, 1),
+			"%s with the %s model: expected %v, got %v", tt.mode, tt.model, tt.expected, res)
+	}
+}
+
+func TestModel_AchromaticSaturation(t *testing.T) {
+	assert := assert.New(t)
+
+	blop := NewBlend()
+	blop.Set(Saturation)
+
+	// The gray backdrop has no hue, so the saturation of the source cannot be applied to it.
+	src := color.NRGBA{R: 40, G: 200, B: 90, A: 255}
+	gray := color.NRGBA{R: 128, G: 128, B: 128, A: 255}
+	expected := []uint8{128, 128, 128, 255}
+
+	for _, model := range []ColorModel{W3CModel, HSLModel, HSVModel, OKLChModel} {
+		assert.NoError(blop.SetColorModel(model))
+		res := blendModel(blop, src, gray)
+		assert.Truef(compareBytes(expected, res, 1), "the %s model: expected %v, got %v", model, expected, res)
+	}
+
+	blop.SetColorModel(W3CModel)
+	blop.SetSpace(OKLabSpace)
+	res := blendModel(blop, src, gray)
+	assert.Truef(compareBytes(expected, res, 1), "the OKLab space: expected %v, got %v", expected, res)
+}
+
+func TestModel_OKLCh(t *testing.T) {
+	assert := assert.New(t)
+
+	blop := NewBlend()
+	blop.SetColorModel(OKLChModel)
+
+	src := color.NRGBA{R: 33, G: 150, B: 243, A: 255}
+	dst := color.NRGBA{R: 233, G: 30, B: 99, A: 255}
+	toLab := func(c []uint8) Lab {
+		return RGBToOKLab(Color{R: float64(c[0]) / 255, G: float64(c[1]) / 255, B: float64(c[2]) / 255})
+	}
+	srcLab, dstLab := toLab([]uint8{src.R, src.G, src.B}), toLab([]uint8{dst.R, dst.G, dst.B})
+
+	// The Luminosity mode keeps the perceived lightness of the source and the hue of the backdrop.
+	blop.Set(Luminosity)
+	res := toLab(blendModel(blop, src, dst))
+	assert.InDelta(srcLab.L, res.L, 0.01)
+	assert.InDelta(angle(dstLab), angle(res), 0.02)
+
+	// The Color mode keeps the perceived lightness of the backdrop and the hue of the source.
+	blop.Set(ColorMode)
+	res = toLab(blendModel(blop, src, dst))
+	assert.InDelta(dstLab.L, res.L, 0.01)
+	assert.InDelta(angle(srcLab), angle(res), 0.02)
+
+	// A gray source has no hue, so the backdrop is kept untouched.
+	blop.Set(Hue)
+	out := blendModel(blop, color.NRGBA{R: 128, G: 128, B: 128, A: 255}, dst)
+	assert.True(compareBytes([]uint8{dst.R, dst.G, dst.B, dst.A}, out, 1))
+}
+
+func TestModel_OKLChLinear(t *testing.T) {
+	assert := assert.New(t)
+
+	blop := NewBlend()
+	blop.SetColorModel(OKLChModel)
+
+	rect := image.Rect(0, 0, 1, 1)
+	src := color.NRGBA{R: 33, G: 150, B: 243, A: 255}
+	dst := color.NRGBA{R: 233, G: 30, B: 99, A: 255}
+
+	// Over an opaque backdrop the OKLCh components don't depend on the encoding of the
+	// channels, so the gamma-correct compositing gives the same result.
+	for _, mode := range []BlendMode{Hue, Saturation, ColorMode, Luminosity} {
+		blop.Set(mode)
+		expected := blendModel(blop, src, dst)
+
+		imop := InitOp()
+		imop.SetLinear(true)
+		bmp := NewBitmap(rect)
+		imop.DrawAt(bmp, rect, image.NewUniform(src), image.Point{}, image.NewUniform(dst), image.Point{}, blop)
+		assert.Truef(compareBytes(expected, bmp.Img.Pix, 1), "mode %s: expected %v, got %v", mode, expected, bmp.Img.Pix)
+	}
+	assert.False(blop.linear)
+}
+
+// blendModel blends a single source pixel over a backdrop pixel and returns the resulting pixel.
+func blendModel(blop *Blend, src, dst color.NRGBA) []uint8 {
+	rect := image.Rect(0, 0, 1, 1)
+	bmp := NewBitmap(rect)
+
+	imop := InitOp()
+	imop.Set(SrcOver)
+	imop.DrawAt(bmp, rect, image.NewUniform(src), image.Point{}, image.NewUniform(dst), image.Point{}, blop)
+
+	return bmp.Img.Pix
+}
+
+func angle(lab Lab) float64 {
+	return math.Atan2(lab.B, lab.A)
+}
@@ -0,0 +1,145 @@
+package gomp
+
+import "math"
+
+// Lab represents a color in the OKLab perceptual color space: L is the perceived lightness,
+// while A and B are the green-red and the blue-yellow axes.
+// See: https://bottosson.github.io/posts/oklab/
+type Lab struct {
+	L, A, B float64
+}
+
+// RGBToOKLab converts an sRGB encoded color into the OKLab color space.
+func RGBToOKLab(c Color) Lab {
+	return linearToOKLab(Color{R: srgbToLinear(c.R), G: srgbToLinear(c.G), B: srgbToLinear(c.B)})
+}
+
+// OKLabToRGB converts an OKLab color into an sRGB encoded color. The colors outside of
+// the sRGB gamut are brought into it by reducing their chroma, preserving the lightness
+// and the hue, as opposed to clipping the channels which would shift the hue.
+// It follows the gamut mapping algorithm of CSS Color Module Level 4:
+// https://www.w3.org/TR/css-color-4/#binsearch
+func OKLabToRGB(lab Lab) Color {
+	return linearToRGB(okLabToGamut(lab))
+}
+
+// okLabToGamut converts an OKLab color into linear sRGB, mapping it into the gamut.
+func okLabToGamut(lab Lab) Color {
+	// The just noticeable difference and the precision of the binary search.
+	const (
+		jnd = 0.02
+		eps = 0.0001
+	)
+	lab.L = clampFloat(lab.L, 0, 1)
+	if lab.L == 0 || lab.L == 1 {
+		return okLabToLinear(Lab{L: lab.L})
+	}
+	rgb := okLabToLinear(lab)
+	if inGamut(rgb) {
+		return rgb
+	}
+	// The colors which are close enough to the gamut are simply clipped.
+	clipped := clipLinear(rgb)
+	if deltaEOK(linearToOKLab(clipped), lab) < jnd {
+		return clipped
+	}
+
+	c := math.Hypot(lab.A, lab.B)
+	ca, cb := lab.A/c, lab.B/c
+	lo, hi := 0.0, c
+	for hi-lo > eps {
+		mid := (lo + hi) / 2
+		candidate := Lab{L: lab.L, A: mid * ca, B: mid * cb}
+		rgb = okLabToLinear(candidate)
+		if inGamut(rgb) {
+			lo = mid
+			continue
+		}
+		clipped = clipLinear(rgb)
+		e := deltaEOK(linearToOKLab(clipped), candidate)
+		if e < jnd {
+			if jnd-e < eps {
+				break
+			}
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return clipLinear(rgb)
+}
+
+// linearToOKLab converts a linear sRGB color into the OKLab color space.
+func linearToOKLab(c Color) Lab {
+	l := math.Cbrt(0.4122214708*c.R + 0.5363325363*c.G + 0.0514459929*c.B)
+	m := math.Cbrt(0.2119034982*c.R + 0.6806995451*c.G + 0.1073969566*c.B)
+	s := math.Cbrt(0.0883024619*c.R + 0.2817188376*c.G + 0.6299787005*c.B)
+
+	return Lab{
+		L: 0.2104542553*l + 0.7936177850*m - 0.0040720468*s,
+		A: 1.9779984951*l - 2.4285922050*m + 0.4505937099*s,
+		B: 0.0259040371*l + 0.7827717662*m - 0.8086757660*s,
+	}
+}
+
+// deltaEOK returns the euclidean distance between two OKLab colors.
+func deltaEOK(x, y Lab) float64 {
+	dl, da, db := x.L-y.L, x.A-y.A, x.B-y.B
+	return math.Sqrt(dl*dl + da*da + db*db)
+}
+
+// okLabToLinear converts an OKLab color into linear sRGB, without any gamut mapping.
+func okLabToLinear(lab Lab) Color {
+	l := lab.L + 0.3963377774*lab.A + 0.2158037573*lab.B
+	m := lab.L - 0.1055613458*lab.A - 0.0638541728*lab.B
+	s := lab.L - 0.0894841775*lab.A - 1.2914855480*lab.B
+	l, m, s = l*l*l, m*m*m, s*s*s
+
+	return Color{
+		R: 4.0767416621*l - 3.3077115913*m + 0.2309699292*s,
+		G: -1.2684380046*l + 2.6097574011*m - 0.3413193965*s,
+		B: -0.0041960863*l - 0.7034186147*m + 1.7076147010*s,
+	}
+}
+
+// inGamut reports whether a linear color is inside the sRGB gamut, tolerating the rounding errors.
+func inGamut(c Color) bool {
+	const eps = 1e-7
+	return c.R >= -eps && c.R <= 1+eps &&
+		c.G >= -eps && c.G <= 1+eps &&
+		c.B >= -eps && c.B <= 1+eps
+}
+
+// clipLinear clamps the channels of a linear color into the [0, 1] range.
+func clipLinear(c Color) Color {
+	return Color{R: clampFloat(c.R, 0, 1), G: clampFloat(c.G, 0, 1), B: clampFloat(c.B, 0, 1)}
+}
+
+// linearToRGB encodes a linear color into sRGB, clamping the channels into the [0, 1] range.
+func linearToRGB(c Color) Color {
+	c = clipLinear(c)
+	return Color{R: linearToSRGB(c.R), G: linearToSRGB(c.G), B: linearToSRGB(c.B)}
+}
+
+// rgbToOKLCh converts an sRGB encoded color into the cylindrical form of OKLab,
+// returning the hue angle in radians, the chroma and the lightness.
+func rgbToOKLCh(c Color) (h, ch, l float64) {
+	lab := RGBToOKLab(c)
+	return math.Atan2(lab.B, lab.A), math.Hypot(lab.A, lab.B), lab.L
+}
+
+// okLChToRGB converts an OKLCh color into an sRGB encoded color, mapping it into the gamut.
+func okLChToRGB(h, ch, l float64) Color {
+	return OKLabToRGB(Lab{L: l, A: ch * math.Cos(h), B: ch * math.Sin(h)})
+}
+
+// linearToOKLCh is the variant of rgbToOKLCh converting a linear sRGB color.
+func linearToOKLCh(c Color) (h, ch, l float64) {
+	lab := linearToOKLab(clipLinear(c))
+	return math.Atan2(lab.B, lab.A), math.Hypot(lab.A, lab.B), lab.L
+}
+
+// okLChToLinear is the variant of okLChToRGB returning a linear sRGB color.
+func okLChToLinear(h, ch, l float64) Color {
+	return okLabToGamut(Lab{L: l, A: ch * math.Cos(h), B: ch * math.Sin(h)})
+}
@@ -0,0 +1,85 @@
+package gomp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOKLab_Reference(t *testing.T) {
+	assert := assert.New(t)
+
+	// Reference values published along the OKLab color space: https://bottosson.github.io/posts/oklab/
+	tests := []struct {
+		rgb Color
+		lab Lab
+	}{
+		{Color{R: 1, G: 1, B: 1}, Lab{L: 1, A: 0, B: 0}},
+		{Color{R: 0, G: 0, B: 0}, Lab{L: 0, A: 0, B: 0}},
+		{Color{R: 1, G: 0, B: 0}, Lab{L: 0.627955, A: 0.224863, B: 0.125846}},
+		{Color{R: 0, G: 1, B: 0}, Lab{L: 0.866440, A: -0.233888, B: 0.179498}},
+		{Color{R: 0, G: 0, B: 1}, Lab{L: 0.452014, A: -0.032457, B: -0.311528}},
+	}
+	for _, tt := range tests {
+		lab := RGBToOKLab(tt.rgb)
+		assert.InDelta(tt.lab.L, lab.L, 1e-5)
+		assert.InDelta(tt.lab.A, lab.A, 1e-5)
+		assert.InDelta(tt.lab.B, lab.B, 1e-5)
+
+		rgb := OKLabToRGB(tt.lab)
+		assert.InDelta(tt.rgb.R, rgb.R, 1e-4)
+		assert.InDelta(tt.rgb.G, rgb.G, 1e-4)
+		assert.InDelta(tt.rgb.B, rgb.B, 1e-4)
+	}
+}
+
+func TestOKLab_Roundtrip(t *testing.T) {
+	assert := assert.New(t)
+
+	for r := 0; r <= 255; r += 15 {
+		for g := 0; g <= 255; g += 15 {
+			for b := 0; b <= 255; b += 15 {
+				c := Color{R: float64(r) / 255, G: float64(g) / 255, B: float64(b) / 255}
+				res := OKLabToRGB(RGBToOKLab(c))
+				if !assert.InDelta(c.R, res.R, 1e-5) ||
+					!assert.InDelta(c.G, res.G, 1e-5) ||
+					!assert.InDelta(c.B, res.B, 1e-5) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func TestOKLab_GamutMapping(t *testing.T) {
+	assert := assert.New(t)
+
+	// A highly saturated red, outside of the sRGB gamut.
+	lab := Lab{L: 0.6, A: 0.4, B: 0.2}
+	assert.False(inGamut(okLabToLinear(lab)))
+
+	rgb := OKLabToRGB(lab)
+	for _, ch := range []float64{rgb.R, rgb.G, rgb.B} {
+		assert.GreaterOrEqual(ch, 0.0)
+		assert.LessOrEqual(ch, 1.0)
+	}
+	// The chroma is reduced, while the lightness and the hue are preserved
+	// up to the just noticeable difference tolerated by the gamut mapping.
+	res := RGBToOKLab(rgb)
+	assert.InDelta(lab.L, res.L, 0.02)
+	assert.InDelta(angle(lab), angle(res), 0.05)
+	assert.Less(res.A*res.A+res.B*res.B, lab.A*lab.A+lab.B*lab.B)
+
+	// The colors which are barely outside of the gamut are clipped.
+	blue := OKLabToRGB(Lab{L: 0.452014, A: -0.032457, B: -0.311528})
+	assert.InDelta(0, blue.R, 1e-4)
+	assert.InDelta(0, blue.G, 1e-4)
+	assert.InDelta(1, blue.B, 1e-4)
+
+	// The lightness is clamped into the [0, 1] range.
+	white := OKLabToRGB(Lab{L: 1.5})
+	assert.InDelta(1, white.R, 1e-9)
+	assert.InDelta(1, white.G, 1e-9)
+	assert.InDelta(1, white.B, 1e-9)
+	assert.Equal(Color{}, OKLabToRGB(Lab{L: -0.5}))
+}
@@ -0,0 +1,373 @@
+package gomp
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Pixel holds the channels of a single pixel normalized into the [0, 1] range.
+type Pixel struct {
+	R, G, B, A float64
+}
+
+// premultiply multiplies the color channels of a non-premultiplied pixel with its alpha.
+func (p Pixel) premultiply() Pixel {
+	return Pixel{R: p.R * p.A, G: p.G * p.A, B: p.B * p.A, A: p.A}
+}
+
+// unpremultiply divides the color channels of an alpha-premultiplied pixel by its alpha.
+func (p Pixel) unpremultiply() Pixel {
+	if p.A == 0 {
+		return Pixel{}
+	}
+	return Pixel{R: p.R / p.A, G: p.G / p.A, B: p.B / p.A, A: p.A}
+}
+
+// scale multiplies all the channels of a pixel with the same factor.
+func (p Pixel) scale(f float64) Pixel {
+	return Pixel{R: p.R * f, G: p.G * f, B: p.B * f, A: p.A * f}
+}
+
+// add sums the channels of two pixels.
+func (p Pixel) add(q Pixel) Pixel {
+	return Pixel{R: p.R + q.R, G: p.G + q.G, B: p.B + q.B, A: p.A + q.A}
+}
+
+// clamp clamps all the channels of a non-premultiplied pixel into the [0, 1] range.
+func (p Pixel) clamp() Pixel {
+	return Pixel{
+		R: clampFloat(p.R, 0, 1),
+		G: clampFloat(p.G, 0, 1),
+		B: clampFloat(p.B, 0, 1),
+		A: clampFloat(p.A, 0, 1),
+	}
+}
+
+// clampPremultiplied clamps the alpha of a premultiplied pixel into
+// the [0, 1] range and the color channels between 0 and the alpha.
+func (p Pixel) clampPremultiplied() Pixel {
+	a := clampFloat(p.A, 0, 1)
+
+	return Pixel{
+		R: clampFloat(p.R, 0, a),
+		G: clampFloat(p.G, 0, a),
+		B: clampFloat(p.B, 0, a),
+		A: a,
+	}
+}
+
+// nrgbaPixel converts the channels of a non-premultiplied 8-bit color
+// into a normalized, alpha-premultiplied pixel.
+func nrgbaPixel(r, g, b, a uint8) Pixel {
+	alpha := float64(a) / 255
+
+	return Pixel{
+		R: float64(r) / 255 * alpha,
+		G: float64(g) / 255 * alpha,
+		B: float64(b) / 255 * alpha,
+		A: alpha,
+	}
+}
+
+// rgbaPixel converts the channels of an alpha-premultiplied 8-bit color into a normalized pixel.
+func rgbaPixel(r, g, b, a uint8) Pixel {
+	return Pixel{
+		R: float64(r) / 255,
+		G: float64(g) / 255,
+		B: float64(b) / 255,
+		A: float64(a) / 255,
+	}
+}
+
+// nrgba64Pixel converts the channels of a non-premultiplied 16-bit color
+// into a normalized, alpha-premultiplied pixel.
+func nrgba64Pixel(r, g, b, a uint16) Pixel {
+	alpha := float64(a) / 0xffff
+
+	return Pixel{
+		R: float64(r) / 0xffff * alpha,
+		G: float64(g) / 0xffff * alpha,
+		B: float64(b) / 0xffff * alpha,
+		A: alpha,
+	}
+}
+
+// rgba64Pixel converts the channels of an alpha-premultiplied 16-bit color into a normalized pixel.
+func rgba64Pixel(r, g, b, a uint16) Pixel {
+	return Pixel{
+		R: float64(r) / 0xffff,
+		G: float64(g) / 0xffff,
+		B: float64(b) / 0xffff,
+		A: float64(a) / 0xffff,
+	}
+}
+
+// pixelAt returns the normalized, alpha-premultiplied pixel of img located at (x, y).
+func pixelAt(img image.Image, x, y int) Pixel {
+	c := img.At(x, y)
+	switch v := c.(type) {
+	case color.NRGBA:
+		return nrgbaPixel(v.R, v.G, v.B, v.A)
+	case color.RGBA:
+		return rgbaPixel(v.R, v.G, v.B, v.A)
+	case color.NRGBA64:
+		return nrgba64Pixel(v.R, v.G, v.B, v.A)
+	case FloatColor:
+		return Pixel{R: float64(v.R), G: float64(v.G), B: float64(v.B), A: float64(v.A)}
+	}
+	r, g, b, a := c.RGBA()
+
+	return rgba64Pixel(uint16(r), uint16(g), uint16(b), uint16(a))
+}
+
+// loadRow decodes len(buf) consecutive pixels of img starting at (x, y) into normalized,
+// alpha-premultiplied pixels. The *image.NRGBA, *image.RGBA, *image.NRGBA64, *image.RGBA64
+// and *FloatRGBA images are read directly from the Pix slice.
+func loadRow(img image.Image, x, y int, buf []Pixel) {
+	switch img := img.(type) {
+	case *image.NRGBA:
+		i := img.PixOffset(x, y)
+		for k := range buf {
+			s := img.Pix[i : i+4 : i+4]
+			buf[k] = nrgbaPixel(s[0], s[1], s[2], s[3])
+			i += 4
+		}
+	case *image.RGBA:
+		i := img.PixOffset(x, y)
+		for k := range buf {
+			s := img.Pix[i : i+4 : i+4]
+			buf[k] = rgbaPixel(s[0], s[1], s[2], s[3])
+			i += 4
+		}
+	case *image.NRGBA64:
+		i := img.PixOffset(x, y)
+		for k := range buf {
+			s := img.Pix[i : i+8 : i+8]
+			buf[k] = nrgba64Pixel(
+				uint16(s[0])<<8|uint16(s[1]),
+				uint16(s[2])<<8|uint16(s[3]),
+				uint16(s[4])<<8|uint16(s[5]),
+				uint16(s[6])<<8|uint16(s[7]),
+			)
+			i += 8
+		}
+	case *image.RGBA64:
+		i := img.PixOffset(x, y)
+		for k := range buf {
+			s := img.Pix[i : i+8 : i+8]
+			buf[k] = rgba64Pixel(
+				uint16(s[0])<<8|uint16(s[1]),
+				uint16(s[2])<<8|uint16(s[3]),
+				uint16(s[4])<<8|uint16(s[5]),
+				uint16(s[6])<<8|uint16(s[7]),
+			)
+			i += 8
+		}
+	case *FloatRGBA:
+		i := img.PixOffset(x, y)
+		for k := range buf {
+			s := img.Pix[i : i+4 : i+4]
+			buf[k] = Pixel{R: float64(s[0]), G: float64(s[1]), B: float64(s[2]), A: float64(s[3])}
+			i += 4
+		}
+	default:
+		for k := range buf {
+			buf[k] = pixelAt(img, x+k, y)
+		}
+	}
+}
+
+// loadStraightRow is the variant of loadRow decoding non-premultiplied pixels. The *image.NRGBA and
+// *image.NRGBA64 images, as well as the non-premultiplied colors, keep the colors of the transparent
+// pixels, while for the other images these are lost by the premultiplication.
+func loadStraightRow(img image.Image, x, y int, buf []Pixel) {
+	switch img := img.(type) {
+	case *image.NRGBA:
+		i := img.PixOffset(x, y)
+		for k := range buf {
+			s := img.Pix[i : i+4 : i+4]
+			buf[k] = Pixel{R: float64(s[0]) / 255, G: float64(s[1]) / 255, B: float64(s[2]) / 255, A: float64(s[3]) / 255}
+			i += 4
+		}
+	case *image.NRGBA64:
+		i := img.PixOffset(x, y)
+		for k := range buf {
+			s := img.Pix[i : i+8 : i+8]
+			buf[k] = Pixel{
+				R: float64(uint16(s[0])<<8|uint16(s[1])) / 0xffff,
+				G: float64(uint16(s[2])<<8|uint16(s[3])) / 0xffff,
+				B: float64(uint16(s[4])<<8|uint16(s[5])) / 0xffff,
+				A: float64(uint16(s[6])<<8|uint16(s[7])) / 0xffff,
+			}
+			i += 8
+		}
+	default:
+		for k := range buf {
+			switch c := img.At(x+k, y).(type) {
+			case color.NRGBA:
+				buf[k] = Pixel{R: float64(c.R) / 255, G: float64(c.G) / 255, B: float64(c.B) / 255, A: float64(c.A) / 255}
+			case color.NRGBA64:
+				buf[k] = Pixel{R: float64(c.R) / 0xffff, G: float64(c.G) / 0xffff, B: float64(c.B) / 0xffff, A: float64(c.A) / 0xffff}
+			default:
+				buf[k] = pixelAt(img, x+k, y).unpremultiply()
+			}
+		}
+	}
+}
+
+// loadAlphaRow decodes the alpha channel of len(buf) consecutive pixels
+// of img starting at (x, y) into values normalized into the [0, 1] range.
+func loadAlphaRow(img image.Image, x, y int, buf []float64) {
+	switch img := img.(type) {
+	case *image.Alpha:
+		i := img.PixOffset(x, y)
+		for k := range buf {
+			buf[k] = float64(img.Pix[i+k]) / 255
+		}
+	case *image.Uniform:
+		_, _, _, a := img.C.RGBA()
+		for k := range buf {
+			buf[k] = float64(a) / 0xffff
+		}
+	default:
+		for k := range buf {
+			_, _, _, a := img.At(x+k, y).RGBA()
+			buf[k] = float64(a) / 0xffff
+		}
+	}
+}
+
+// storeRow writes len(buf) alpha-premultiplied pixels into img starting at (x, y).
+// The *image.NRGBA, *image.RGBA, *image.NRGBA64, *image.RGBA64 and *FloatRGBA images are
+// written directly into the Pix slice. The channels are rounded to the nearest value and,
+// except for the *FloatRGBA images, they are clamped into the range supported by the image.
+// If linear is set, the pixels are in linear light and they are encoded with the sRGB
+// transfer function, except for the *FloatRGBA images which hold linear values.
+func storeRow(img draw.Image, x, y int, buf []Pixel, linear bool) {
+	switch img := img.(type) {
+	case *image.NRGBA:
+		i := img.PixOffset(x, y)
+		for _, p := range buf {
+			putNRGBA(img.Pix[i:i+4:i+4], p.unpremultiply().clamp(), linear)
+			i += 4
+		}
+	case *image.RGBA:
+		i := img.PixOffset(x, y)
+		for _, p := range buf {
+			if linear {
+				p = p.unpremultiply().clamp().toSRGB().premultiply()
+			}
+			p = p.clampPremultiplied()
+			d := img.Pix[i : i+4 : i+4]
+			d[0] = to8(p.R)
+			d[1] = to8(p.G)
+			d[2] = to8(p.B)
+			d[3] = to8(p.A)
+			i += 4
+		}
+	case *image.NRGBA64:
+		i := img.PixOffset(x, y)
+		for _, p := range buf {
+			putNRGBA64(img.Pix[i:i+8:i+8], p.unpremultiply().clamp(), linear)
+			i += 8
+		}
+	case *image.RGBA64:
+		i := img.PixOffset(x, y)
+		for _, p := range buf {
+			if linear {
+				p = p.unpremultiply().clamp().toSRGB().premultiply()
+			}
+			put16(img.Pix[i:i+8:i+8], p.clampPremultiplied())
+			i += 8
+		}
+	case *FloatRGBA:
+		i := img.PixOffset(x, y)
+		for _, p := range buf {
+			d := img.Pix[i : i+4 : i+4]
+			d[0], d[1], d[2], d[3] = float32(p.R), float32(p.G), float32(p.B), float32(p.A)
+			i += 4
+		}
+	default:
+		for k, p := range buf {
+			if linear {
+				p = p.unpremultiply().clamp().toSRGB().premultiply()
+			}
+			p = p.clampPremultiplied()
+			img.Set(x+k, y, color.RGBA64{
+				R: to16(p.R),
+				G: to16(p.G),
+				B: to16(p.B),
+				A: to16(p.A),
+			})
+		}
+	}
+}
+
+// storeStraightRow is the variant of storeRow for non-premultiplied pixels. The *image.NRGBA and
+// *image.NRGBA64 images keep the colors of the transparent pixels, while the other images receive
+// the premultiplied pixels, the buffer being modified in this case.
+func storeStraightRow(img draw.Image, x, y int, buf []Pixel, linear bool) {
+	switch img := img.(type) {
+	case *image.NRGBA:
+		i := img.PixOffset(x, y)
+		for _, p := range buf {
+			putNRGBA(img.Pix[i:i+4:i+4], p.clamp(), linear)
+			i += 4
+		}
+	case *image.NRGBA64:
+		i := img.PixOffset(x, y)
+		for _, p := range buf {
+			putNRGBA64(img.Pix[i:i+8:i+8], p.clamp(), linear)
+			i += 8
+		}
+	default:
+		for k, p := range buf {
+			buf[k] = p.clamp().premultiply()
+		}
+		storeRow(img, x, y, buf, linear)
+	}
+}
+
+// putNRGBA writes the channels of a clamped, non-premultiplied pixel as 8-bit values,
+// encoding the color channels with the sRGB transfer function if linear is set.
+func putNRGBA(d []uint8, p Pixel, linear bool) {
+	if linear {
+		d[0] = toSRGB8(p.R)
+		d[1] = toSRGB8(p.G)
+		d[2] = toSRGB8(p.B)
+	} else {
+		d[0] = to8(p.R)
+		d[1] = to8(p.G)
+		d[2] = to8(p.B)
+	}
+	d[3] = to8(p.A)
+}
+
+// putNRGBA64 writes the channels of a clamped, non-premultiplied pixel as big-endian 16-bit values,
+// encoding the color channels with the sRGB transfer function if linear is set.
+func putNRGBA64(d []uint8, p Pixel, linear bool) {
+	if linear {
+		p = p.toSRGB()
+	}
+	put16(d, p)
+}
+
+// put16 writes the channels of a pixel as big-endian 16-bit values.
+func put16(d []uint8, p Pixel) {
+	r, g, b, a := to16(p.R), to16(p.G), to16(p.B), to16(p.A)
+	d[0], d[1] = uint8(r>>8), uint8(r)
+	d[2], d[3] = uint8(g>>8), uint8(g)
+	d[4], d[5] = uint8(b>>8), uint8(b)
+	d[6], d[7] = uint8(a>>8), uint8(a)
+}
+
+// to8 converts a normalized channel into an 8-bit value, rounding it to the nearest integer.
+func to8(c float64) uint8 {
+	return uint8(c*0xff + 0.5)
+}
+
+// to16 converts a normalized channel into a 16-bit value, rounding it to the nearest integer.
+func to16(c float64) uint16 {
+	return uint16(c*0xffff + 0.5)
+}
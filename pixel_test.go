@@ -0,0 +1,106 @@
+package gomp
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPixel_LoadStore(t *testing.T) {
+	assert := assert.New(t)
+
+	rect := image.Rect(-3, 2, 61, 6)
+	src := makeTestImage(rect, 5)
+	// Opaque pixels are converted without loss between any of the image types.
+	for i := 3; i < len(src.Pix); i += 4 {
+		src.Pix[i] = 0xff
+	}
+
+	for _, img := range []draw.Image{
+		image.NewNRGBA(rect),
+		image.NewRGBA(rect),
+		image.NewNRGBA64(rect),
+		image.NewRGBA64(rect),
+		genericDrawImage{image.NewRGBA64(rect)},
+	} {
+		draw.Draw(img, rect, src, rect.Min, draw.Src)
+
+		buf := make([]Pixel, rect.Dx())
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			loadRow(img, rect.Min.X, y, buf)
+			for k, p := range buf {
+				assert.Equal(pixelAt(img, rect.Min.X+k, y), p, "%T", img)
+			}
+			out := image.NewNRGBA(rect)
+			storeRow(out, rect.Min.X, y, buf, false)
+			assert.Equal(src.Pix[src.PixOffset(rect.Min.X, y):src.PixOffset(rect.Max.X, y)],
+				out.Pix[out.PixOffset(rect.Min.X, y):out.PixOffset(rect.Max.X, y)], "%T", img)
+
+			storeRow(img, rect.Min.X, y, buf, false)
+		}
+		assert.Equal(src.Pix, ImgToNRGBA(img).Pix, "%T", img)
+	}
+}
+
+func TestPixel_Store16(t *testing.T) {
+	assert := assert.New(t)
+
+	rect := image.Rect(0, 0, 4, 1)
+	buf := []Pixel{
+		{R: 0, G: 0, B: 0, A: 0},
+		{R: 0.25, G: 0.5, B: 0.75, A: 1},
+		{R: 0.1, G: 0.2, B: 0.3, A: 0.5},
+		{R: 1, G: 1, B: 1, A: 1},
+	}
+
+	nrgba64 := image.NewNRGBA64(rect)
+	storeRow(nrgba64, 0, 0, buf, false)
+	assert.Equal(color.NRGBA64{}, nrgba64.NRGBA64At(0, 0))
+	assert.Equal(color.NRGBA64{R: 0x4000, G: 0x8000, B: 0xbfff, A: 0xffff}, nrgba64.NRGBA64At(1, 0))
+	assert.Equal(color.NRGBA64{R: 0x3333, G: 0x6666, B: 0x9999, A: 0x8000}, nrgba64.NRGBA64At(2, 0))
+	assert.Equal(color.NRGBA64{R: 0xffff, G: 0xffff, B: 0xffff, A: 0xffff}, nrgba64.NRGBA64At(3, 0))
+
+	rgba64 := image.NewRGBA64(rect)
+	storeRow(rgba64, 0, 0, buf, false)
+	assert.Equal(color.RGBA64{R: 0x199a, G: 0x3333, B: 0x4ccd, A: 0x8000}, rgba64.RGBA64At(2, 0))
+
+	loaded := make([]Pixel, len(buf))
+	loadRow(rgba64, 0, 0, loaded)
+	for i := range buf {
+		assert.InDelta(buf[i].R, loaded[i].R, 0.5/0xffff)
+		assert.InDelta(buf[i].G, loaded[i].G, 0.5/0xffff)
+		assert.InDelta(buf[i].B, loaded[i].B, 0.5/0xffff)
+		assert.InDelta(buf[i].A, loaded[i].A, 0.5/0xffff)
+	}
+}
+
+func TestPixel_RoundTripNRGBA(t *testing.T) {
+	assert := assert.New(t)
+
+	// Every value is combined with every alpha level strictly between 0 and 255.
+	rect := image.Rect(0, 1, 256, 255)
+	src := image.NewNRGBA(rect)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(255 - x), B: uint8(x * 7), A: uint8(y)})
+		}
+	}
+
+	// Composited onto a transparent backdrop, the semi-transparent pixels are kept unchanged.
+	imop := InitOp()
+	for _, op := range []CompositeOp{Copy, SrcOver} {
+		imop.Set(op)
+		bmp := NewBitmap(rect)
+		imop.Draw(bmp, src, image.NewNRGBA(rect), nil)
+		assert.Equal(src.Pix, bmp.Img.Pix, "operator %s", op)
+	}
+}
+
+// genericDrawImage hides the concrete type of the embedded image,
+// forcing the usage of the generic pixel accessors.
+type genericDrawImage struct {
+	draw.Image
+}
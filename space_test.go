@@ -0,0 +1,127 @@
+package gomp
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The OKLab references of the sRGB primaries: https://bottosson.github.io/posts/oklab/
+var (
+	redLab   = Lab{L: 0.627955, A: 0.224863, B: 0.125846}
+	greenLab = Lab{L: 0.866440, A: -0.233888, B: 0.179498}
+	blueLab  = Lab{L: 0.452014, A: -0.032457, B: -0.311528}
+)
+
+func TestSpace_Basic(t *testing.T) {
+	assert := assert.New(t)
+
+	blop := NewBlend()
+	assert.Equal(RGBSpace, blop.Space)
+	assert.Error(blop.SetSpace("xyz"))
+	assert.NoError(blop.SetSpace(OKLabSpace))
+	assert.Equal(OKLabSpace, blop.Space)
+
+	// The Normal blend mode converts the source into OKLab and back.
+	blop.Set(Normal)
+	src := color.NRGBA{R: 214, G: 20, B: 65, A: 255}
+	dst := color.NRGBA{R: 33, G: 150, B: 243, A: 255}
+	assert.True(compareBytes([]uint8{214, 20, 65, 255}, blendModel(blop, src, dst), 1))
+
+	// Over a transparent backdrop the source is kept unchanged.
+	blop.Set(Multiply)
+	dst.A = 0
+	assert.True(compareBytes([]uint8{214, 20, 65, 255}, blendModel(blop, src, dst), 1))
+}
+
+func TestSpace_OKLab(t *testing.T) {
+	assert := assert.New(t)
+
+	red := color.NRGBA{R: 255, A: 255}
+	green := color.NRGBA{G: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+	toLab := func(c []uint8) Lab {
+		return RGBToOKLab(Color{R: float64(c[0]) / 255, G: float64(c[1]) / 255, B: float64(c[2]) / 255})
+	}
+
+	blop := NewBlend()
+	blop.SetSpace(OKLabSpace)
+
+	// The lightness and both axes of blue are lower than the ones of red.
+	blop.Set(Darken)
+	assert.True(compareBytes([]uint8{0, 0, 255, 255}, blendModel(blop, red, blue), 1))
+	blop.Set(Lighten)
+	assert.True(compareBytes([]uint8{255, 0, 0, 255}, blendModel(blop, red, blue), 1))
+
+	// Lightening red with green takes the lightness and the b axis of green, and the a axis of red.
+	// The resulting color is outside of the sRGB gamut, so its chroma is reduced.
+	out := blendModel(blop, red, green)
+	c := OKLabToRGB(Lab{L: greenLab.L, A: redLab.A, B: greenLab.B})
+	assert.True(compareBytes([]uint8{uint8(c.R * 255), uint8(c.G * 255), uint8(c.B * 255), 255}, out, 1))
+	res := toLab(out)
+	assert.InDelta(greenLab.L, res.L, 0.02)
+
+	// The non-separable blend modes use the OKLCh components.
+	blop.Set(Luminosity)
+	res = toLab(blendModel(blop, green, red))
+	assert.InDelta(greenLab.L, res.L, 0.02)
+	assert.InDelta(angle(redLab), angle(res), 0.05)
+
+	// DarkerColor compares the perceived lightness.
+	blop.Set(DarkerColor)
+	assert.True(compareBytes([]uint8{0, 0, 255, 255}, blendModel(blop, red, blue), 1))
+}
+
+func TestSpace_Midtones(t *testing.T) {
+	assert := assert.New(t)
+
+	const average BlendMode = "average"
+	blop := NewBlend()
+	blop.Register(average, func(bl *Blend, src, dst Pixel) Pixel {
+		return Pixel{R: (src.R + dst.R) / 2, G: (src.G + dst.G) / 2, B: (src.B + dst.B) / 2, A: src.A}
+	})
+	blop.Set(average)
+
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+	mid := Lab{
+		L: (redLab.L + blueLab.L) / 2,
+		A: (redLab.A + blueLab.A) / 2,
+		B: (redLab.B + blueLab.B) / 2,
+	}
+
+	// Averaging the sRGB channels produces a darker purple than the OKLab midpoint.
+	rgb := blendModel(blop, red, blue)
+	muddy := RGBToOKLab(Color{R: float64(rgb[0]) / 255, G: float64(rgb[1]) / 255, B: float64(rgb[2]) / 255})
+	assert.Less(muddy.L, mid.L-0.05)
+
+	blop.SetSpace(OKLabSpace)
+	rgb = blendModel(blop, red, blue)
+	res := RGBToOKLab(Color{R: float64(rgb[0]) / 255, G: float64(rgb[1]) / 255, B: float64(rgb[2]) / 255})
+	assert.InDelta(mid.L, res.L, 0.005)
+	assert.InDelta(mid.A, res.A, 0.005)
+	assert.InDelta(mid.B, res.B, 0.005)
+}
+
+func TestSpace_Linear(t *testing.T) {
+	assert := assert.New(t)
+
+	blop := NewBlend()
+	blop.SetSpace(OKLabSpace)
+	blop.Set(Normal)
+
+	imop := InitOp()
+	imop.SetLinear(true)
+	src := makeTestImage(image.Rect(0, 0, 16, 16), 3)
+	dst := makeTestImage(image.Rect(0, 0, 16, 16), 7)
+	for i := 3; i < len(src.Pix); i += 4 {
+		src.Pix[i] = 255
+	}
+
+	// The linear values are converted into OKLab without decoding them again.
+	bmp := NewBitmap(src.Bounds())
+	imop.Draw(bmp, src, dst, blop)
+	assert.True(compareBytes(src.Pix, bmp.Img.Pix, 1))
+}
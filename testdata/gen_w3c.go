@@ -0,0 +1,261 @@
+//go:build ignore
+
+// This program generates the reference vectors used by the W3C conformance tests.
+// The formulas are transcribed independently of the package, from the
+// Compositing and Blending Level 1 specification: https://www.w3.org/TR/compositing-1/
+//
+// Usage: go run testdata/gen_w3c.go > testdata/w3c.csv
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+)
+
+type rgb [3]float64
+
+type vector struct {
+	op, mode string
+	src, dst [4]uint8
+}
+
+// operators maps the Porter-Duff operators to their Fa and Fb terms.
+var operators = []struct {
+	name   string
+	fa, fb func(as, ab float64) float64
+}{
+	{"clear", zero, zero},
+	{"copy", one, zero},
+	{"dst", zero, one},
+	{"src_over", one, func(as, ab float64) float64 { return 1 - as }},
+	{"dst_over", func(as, ab float64) float64 { return 1 - ab }, one},
+	{"src_in", func(as, ab float64) float64 { return ab }, zero},
+	{"dst_in", zero, func(as, ab float64) float64 { return as }},
+	{"src_out", func(as, ab float64) float64 { return 1 - ab }, zero},
+	{"dst_out", zero, func(as, ab float64) float64 { return 1 - as }},
+	{"src_atop", func(as, ab float64) float64 { return ab }, func(as, ab float64) float64 { return 1 - as }},
+	{"dst_atop", func(as, ab float64) float64 { return 1 - ab }, func(as, ab float64) float64 { return as }},
+	{"xor", func(as, ab float64) float64 { return 1 - ab }, func(as, ab float64) float64 { return 1 - as }},
+	// The lighter operator, whose result is clamped.
+	{"plus", one, one},
+}
+
+func zero(as, ab float64) float64 { return 0 }
+func one(as, ab float64) float64  { return 1 }
+
+var separable = map[string]func(cb, cs float64) float64{
+	"normal":   func(cb, cs float64) float64 { return cs },
+	"multiply": func(cb, cs float64) float64 { return cb * cs },
+	"screen":   screen,
+	"overlay":  func(cb, cs float64) float64 { return hardLight(cs, cb) },
+	"darken":   math.Min,
+	"lighten":  math.Max,
+	"color_dodge": func(cb, cs float64) float64 {
+		switch {
+		case cb == 0:
+			return 0
+		case cs == 1:
+			return 1
+		}
+		return math.Min(1, cb/(1-cs))
+	},
+	"color_burn": func(cb, cs float64) float64 {
+		switch {
+		case cb == 1:
+			return 1
+		case cs == 0:
+			return 0
+		}
+		return 1 - math.Min(1, (1-cb)/cs)
+	},
+	"hard_light": hardLight,
+	"soft_light": func(cb, cs float64) float64 {
+		if cs <= 0.5 {
+			return cb - (1-2*cs)*cb*(1-cb)
+		}
+		var d float64
+		if cb <= 0.25 {
+			d = ((16*cb-12)*cb + 4) * cb
+		} else {
+			d = math.Sqrt(cb)
+		}
+		return cb + (2*cs-1)*(d-cb)
+	},
+	"difference": func(cb, cs float64) float64 { return math.Abs(cb - cs) },
+	"exclusion":  func(cb, cs float64) float64 { return cb + cs - 2*cb*cs },
+}
+
+var nonSeparable = map[string]func(cb, cs rgb) rgb{
+	"hue":        func(cb, cs rgb) rgb { return setLum(setSat(cs, sat(cb)), lum(cb)) },
+	"saturation": func(cb, cs rgb) rgb { return setLum(setSat(cb, sat(cs)), lum(cb)) },
+	"color":      func(cb, cs rgb) rgb { return setLum(cs, lum(cb)) },
+	"luminosity": func(cb, cs rgb) rgb { return setLum(cb, lum(cs)) },
+}
+
+func screen(cb, cs float64) float64 { return cb + cs - cb*cs }
+
+func hardLight(cb, cs float64) float64 {
+	if cs <= 0.5 {
+		return cb * 2 * cs
+	}
+	return screen(cb, 2*cs-1)
+}
+
+func lum(c rgb) float64 { return 0.3*c[0] + 0.59*c[1] + 0.11*c[2] }
+
+func clipColor(c rgb) rgb {
+	l := lum(c)
+	n := math.Min(c[0], math.Min(c[1], c[2]))
+	x := math.Max(c[0], math.Max(c[1], c[2]))
+	for i := range c {
+		if n < 0 {
+			c[i] = l + (c[i]-l)*l/(l-n)
+		}
+	}
+	for i := range c {
+		if x > 1 {
+			c[i] = l + (c[i]-l)*(1-l)/(x-l)
+		}
+	}
+	return c
+}
+
+func setLum(c rgb, l float64) rgb {
+	d := l - lum(c)
+	return clipColor(rgb{c[0] + d, c[1] + d, c[2] + d})
+}
+
+func sat(c rgb) float64 {
+	return math.Max(c[0], math.Max(c[1], c[2])) - math.Min(c[0], math.Min(c[1], c[2]))
+}
+
+func setSat(c rgb, s float64) rgb {
+	// Indices of the minimum, middle and maximum channels.
+	lo, mid, hi := 0, 1, 2
+	if c[lo] > c[mid] {
+		lo, mid = mid, lo
+	}
+	if c[mid] > c[hi] {
+		mid, hi = hi, mid
+	}
+	if c[lo] > c[mid] {
+		lo, mid = mid, lo
+	}
+	var res rgb
+	if c[hi] > c[lo] {
+		res[mid] = (c[mid] - c[lo]) * s / (c[hi] - c[lo])
+		res[hi] = s
+	}
+	return res
+}
+
+func blend(mode string, cb, cs rgb) rgb {
+	if fn, ok := nonSeparable[mode]; ok {
+		return fn(cb, cs)
+	}
+	fn := separable[mode]
+	return rgb{fn(cb[0], cs[0]), fn(cb[1], cs[1]), fn(cb[2], cs[2])}
+}
+
+// composite returns the non-premultiplied result of the general W3C compositing formula.
+func composite(v vector) [4]float64 {
+	norm := func(p [4]uint8) (rgb, float64) {
+		return rgb{float64(p[0]) / 255, float64(p[1]) / 255, float64(p[2]) / 255}, float64(p[3]) / 255
+	}
+	cs, as := norm(v.src)
+	cb, ab := norm(v.dst)
+
+	// Cs = (1 - αb) x Cs + αb x B(Cb, Cs)
+	b := blend(v.mode, cb, cs)
+	for i := range cs {
+		cs[i] = (1-ab)*cs[i] + ab*b[i]
+	}
+
+	var fa, fb float64
+	for _, op := range operators {
+		if op.name == v.op {
+			fa, fb = op.fa(as, ab), op.fb(as, ab)
+		}
+	}
+	ao := as*fa + ab*fb
+	var co rgb
+	for i := range cs {
+		co[i] = as*fa*cs[i] + ab*fb*cb[i]
+	}
+	if v.op == "plus" {
+		ao = math.Min(1, ao)
+		for i := range co {
+			co[i] = math.Min(1, co[i])
+		}
+	}
+	if ao == 0 {
+		return [4]float64{}
+	}
+	var res [4]float64
+	for i := range co {
+		res[i] = co[i] / ao
+	}
+	res[3] = ao
+
+	return res
+}
+
+func main() {
+	modes := []string{
+		"normal", "darken", "lighten", "multiply", "screen", "overlay", "soft_light", "hard_light",
+		"color_dodge", "color_burn", "difference", "exclusion", "hue", "saturation", "color", "luminosity",
+	}
+	colors := [][2][3]uint8{
+		{{214, 20, 65}, {250, 121, 17}},
+		{{33, 150, 243}, {233, 30, 99}},
+		{{0, 255, 128}, {255, 0, 40}},
+		{{60, 60, 60}, {200, 200, 200}},
+	}
+	alphas := []uint8{0, 64, 128, 192, 255}
+
+	var vectors []vector
+	add := func(op, mode string, pair [2][3]uint8, sa, ba uint8) {
+		s, d := pair[0], pair[1]
+		vectors = append(vectors, vector{op, mode, [4]uint8{s[0], s[1], s[2], sa}, [4]uint8{d[0], d[1], d[2], ba}})
+	}
+	// Every operator without blending, at every alpha combination.
+	for _, op := range operators {
+		for _, pair := range colors[:2] {
+			for _, sa := range alphas {
+				for _, ba := range alphas {
+					add(op.name, "normal", pair, sa, ba)
+				}
+			}
+		}
+	}
+	// Every blend mode composited with source-over, at every alpha combination.
+	for _, mode := range modes[1:] {
+		for _, pair := range colors {
+			for _, sa := range alphas {
+				for _, ba := range alphas {
+					add("src_over", mode, pair, sa, ba)
+				}
+			}
+		}
+	}
+	// Every combination of operator and blend mode, at a few alpha combinations.
+	for _, op := range operators {
+		for _, mode := range modes[1:] {
+			for i, a := range [][2]uint8{{255, 255}, {128, 192}, {192, 64}} {
+				add(op.name, mode, colors[i], a[0], a[1])
+			}
+		}
+	}
+
+	fmt.Println("# op,mode,source RGBA,backdrop RGBA,expected non-premultiplied RGBA")
+	for _, v := range vectors {
+		res := composite(v)
+		fmt.Fprintf(os.Stdout, "%s,%s,%d %d %d %d,%d %d %d %d,%.5f %.5f %.5f %.5f\n",
+			v.op, v.mode,
+			v.src[0], v.src[1], v.src[2], v.src[3],
+			v.dst[0], v.dst[1], v.dst[2], v.dst[3],
+			res[0], res[1], res[2], res[3],
+		)
+	}
+}
@@ -0,0 +1,121 @@
+package gomp
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// The reference vectors are generated by testdata/gen_w3c.go from the formulas of the
+// W3C Compositing and Blending Level 1 specification: https://www.w3.org/TR/compositing-1/
+//
+//go:embed testdata/w3c.csv
+var w3cVectors string
+
+// w3cTolerance is the maximum difference allowed between a normalized channel and its reference value.
+const w3cTolerance = 1e-4
+
+// w3cExcluded holds the built-in operators and blend modes not defined by the specification.
+var w3cExcluded = map[string]bool{
+	string(PlusDarker):   true,
+	string(Saturate):     true,
+	string(Modulate):     true,
+	string(LinearDodge):  true,
+	string(LinearBurn):   true,
+	string(VividLight):   true,
+	string(LinearLight):  true,
+	string(PinLight):     true,
+	string(HardMix):      true,
+	string(Subtract):     true,
+	string(Divide):       true,
+	string(DarkerColor):  true,
+	string(LighterColor): true,
+	string(Dissolve):     true,
+}
+
+type w3cVector struct {
+	line     int
+	op       CompositeOp
+	mode     BlendMode
+	src, dst color.NRGBA
+	want     [4]float64
+}
+
+func parseW3CVectors(t *testing.T) []w3cVector {
+	t.Helper()
+
+	var vectors []w3cVector
+	sc := bufio.NewScanner(strings.NewReader(w3cVectors))
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) != 5 {
+			t.Fatalf("line %d: expected 5 fields, got %d", line, len(fields))
+		}
+		v := w3cVector{line: line, op: CompositeOp(fields[0]), mode: BlendMode(fields[1])}
+		_, err := fmt.Sscan(fields[2], &v.src.R, &v.src.G, &v.src.B, &v.src.A)
+		if err == nil {
+			_, err = fmt.Sscan(fields[3], &v.dst.R, &v.dst.G, &v.dst.B, &v.dst.A)
+		}
+		if err == nil {
+			_, err = fmt.Sscan(fields[4], &v.want[0], &v.want[1], &v.want[2], &v.want[3])
+		}
+		if err != nil {
+			t.Fatalf("line %d: %v", line, err)
+		}
+		vectors = append(vectors, v)
+	}
+	return vectors
+}
+
+func TestW3C_Conformance(t *testing.T) {
+	imop := InitOp()
+	blop := NewBlend()
+	rect := image.Rect(0, 0, 1, 1)
+	bmp := NewBitmapFrom(image.NewNRGBA64(rect))
+
+	vectors := parseW3CVectors(t)
+	covered := make(map[string]bool)
+
+	for _, v := range vectors {
+		if err := imop.Set(v.op); err != nil {
+			t.Fatalf("line %d: %v", v.line, err)
+		}
+		if err := blop.Set(v.mode); err != nil {
+			t.Fatalf("line %d: %v", v.line, err)
+		}
+		covered[string(v.op)] = true
+		covered[string(v.mode)] = true
+
+		imop.DrawAt(bmp, rect, image.NewUniform(v.src), image.Point{}, image.NewUniform(v.dst), image.Point{}, blop)
+		c := bmp.Image().(*image.NRGBA64).NRGBA64At(0, 0)
+
+		got := [4]float64{float64(c.R) / 0xffff, float64(c.G) / 0xffff, float64(c.B) / 0xffff, float64(c.A) / 0xffff}
+		for i, ch := range "RGBA" {
+			if diff := Abs(got[i] - v.want[i]); diff > w3cTolerance {
+				t.Errorf("line %d: %s with %s, source %v, backdrop %v: channel %c is %.5f, expected %.5f (diff %.5f)",
+					v.line, v.op, v.mode, v.src, v.dst, ch, got[i], v.want[i], diff)
+			}
+		}
+	}
+
+	// The vectors have to cover every built-in operator and blend mode,
+	// except for the ones which are not defined by the specification.
+	for _, op := range imop.Ops {
+		if !covered[string(op)] && !w3cExcluded[string(op)] {
+			t.Errorf("missing reference vectors for operator %s", op)
+		}
+	}
+	for _, mode := range blop.Modes {
+		if !covered[string(mode)] && !w3cExcluded[string(mode)] {
+			t.Errorf("missing reference vectors for blend mode %s", mode)
+		}
+	}
+}